@@ -0,0 +1,96 @@
+package fdfs_client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BREAKER_WINDOW   = time.Second * 10
+	DEFAULT_BREAKER_COOLDOWN = time.Second * 30
+)
+
+//breaker opens after threshold transport failures in a row, all within
+//window, and then fails every request at once for cooldown. The first
+//request after it is let through, one more failure opens it again
+type breaker struct {
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	lock         sync.Mutex
+	failures     int
+	firstFailure time.Time
+	open         bool
+	openUntil    time.Time
+}
+
+//nil, which lets everything through, unless threshold is set
+func newBreaker(threshold int, window time.Duration, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = DEFAULT_BREAKER_WINDOW
+	}
+	if cooldown <= 0 {
+		cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	return &breaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+func (this *breaker) allow() bool {
+	if this == nil {
+		return true
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return !this.open || !time.Now().Before(this.openUntil)
+}
+
+//open while requests are failed at once, not in the trial after cooldown
+func (this *breaker) isOpen() bool {
+	return !this.allow()
+}
+
+func (this *breaker) success() {
+	if this == nil {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.failures = 0
+	this.open = false
+}
+
+//reports whether this failure opened the breaker
+func (this *breaker) failure() bool {
+	if this == nil {
+		return false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := time.Now()
+	if this.open {
+		if now.Before(this.openUntil) {
+			//a request let through before the breaker opened
+			return false
+		}
+		this.openUntil = now.Add(this.cooldown)
+		return true
+	}
+	if this.failures == 0 || now.Sub(this.firstFailure) > this.window {
+		this.failures = 0
+		this.firstFailure = now
+	}
+	this.failures++
+	if this.failures < this.threshold {
+		return false
+	}
+	this.open = true
+	this.openUntil = now.Add(this.cooldown)
+	return true
+}
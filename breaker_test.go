@@ -0,0 +1,50 @@
+package fdfs_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	breaker := newBreaker(3, time.Minute, 20*time.Millisecond)
+	breaker.failure()
+	breaker.failure()
+	breaker.success()
+	breaker.failure()
+	breaker.failure()
+	if !breaker.allow() {
+		t.Fatal("opened on failures broken by a success")
+	}
+	if !breaker.failure() || breaker.allow() {
+		t.Fatal("not open after 3 failures in a row")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !breaker.allow() {
+		t.Fatal("still closed to a trial after cooldown")
+	}
+	if !breaker.failure() || breaker.allow() {
+		t.Fatal("failed trial didn't open it again")
+	}
+	time.Sleep(30 * time.Millisecond)
+	breaker.success()
+	breaker.failure()
+	if !breaker.allow() {
+		t.Fatal("a successful trial didn't reset the failures")
+	}
+}
+
+func TestBreakerWindow(t *testing.T) {
+	if newBreaker(0, time.Minute, time.Minute) != nil || !(*breaker)(nil).allow() {
+		t.Fatal("threshold 0 should disable the breaker")
+	}
+	breaker := newBreaker(2, 10*time.Millisecond, time.Minute)
+	breaker.failure()
+	time.Sleep(20 * time.Millisecond)
+	if breaker.failure() {
+		t.Fatal("opened on failures further apart than the window")
+	}
+	if !breaker.failure() {
+		t.Fatal("not open after 2 failures within the window")
+	}
+}
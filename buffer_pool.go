@@ -0,0 +1,55 @@
+package fdfs_client
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	DEFAULT_BUFFER_SIZE = 64 * 1024
+)
+
+// bufferPool recycles the copy buffers of uploads and downloads. Each client
+// has its own, sized by buffer_size.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = DEFAULT_BUFFER_SIZE
+	}
+	bufferPool := &bufferPool{size: size}
+	bufferPool.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return bufferPool
+}
+
+func (this *bufferPool) get() []byte {
+	return *this.pool.Get().(*[]byte)
+}
+
+func (this *bufferPool) put(buf []byte) {
+	//sendWithProgress may hand back a shorter slice of a pooled buffer
+	buf = buf[:cap(buf)]
+	if len(buf) == this.size {
+		this.pool.Put(&buf)
+	}
+}
+
+//conns from a pool use its client's buffers, others a fresh one
+func getBuffer(conn net.Conn) []byte {
+	if pConn, ok := conn.(pConn); ok && pConn.pool.buffers != nil {
+		return pConn.pool.buffers.get()
+	}
+	return make([]byte, DEFAULT_BUFFER_SIZE)
+}
+
+func putBuffer(conn net.Conn, buf []byte) {
+	if pConn, ok := conn.(pConn); ok && pConn.pool.buffers != nil {
+		pConn.pool.buffers.put(buf)
+	}
+}
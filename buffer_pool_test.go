@@ -0,0 +1,37 @@
+package fdfs_client
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+//zeroConn reads zeros forever
+type zeroConn struct {
+	net.Conn
+}
+
+func (zeroConn) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func benchmarkWriteFromConn(b *testing.B, conn net.Conn) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := writeFromConn(conn, io.Discard, 1024*1024); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFromConnPooled(b *testing.B) {
+	pool := &connPool{buffers: newBufferPool(DEFAULT_BUFFER_SIZE)}
+	benchmarkWriteFromConn(b, pConn{Conn: zeroConn{}, pool: pool})
+}
+
+func BenchmarkWriteFromConnUnpooled(b *testing.B) {
+	benchmarkWriteFromConn(b, zeroConn{})
+}
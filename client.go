@@ -1,295 +1,1908 @@
 package fdfs_client
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Client struct {
-	trackerPools    map[string]*connPool
+	trackerPools    *trackerSet
+	trackerIndex    uint32
 	storagePools    map[string]*connPool
+	storageBreakers map[string]*breaker
 	storagePoolLock *sync.RWMutex
+	closed          *bool
+	storeCache      *storeCache
 	config          *config
 }
 
-func NewClientWithParas(trackerAddr,maxConns string) (*Client, error) {
-	config := &config{}
-	config.trackerAddr = trackerAddr
-        config.maxConns = strconv.Atoi(maxConns)
-	
+// NewClientWithParas builds a client from a comma separated tracker list
+// and a pool size, without a config file.
+func NewClientWithParas(trackerAddr, maxConns string) (*Client, error) {
+	conns, err := strconv.Atoi(maxConns)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithOptions(WithTrackers(strings.Split(trackerAddr, ",")), WithMaxConns(conns))
+}
+
+// NewClientWithOptions builds a client entirely in code, see the With*
+// options for the settings available.
+func NewClientWithOptions(opts ...Option) (*Client, error) {
+	config := defaultConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return newClient(config)
+}
+
+func NewClientWithConfig(configName string) (*Client, error) {
+	config, err := newConfig(configName)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(config)
+}
+
+// NewClientWithReader is NewClientWithConfig for a config that is not a file
+// on disk, such as one embedded with go:embed.
+func NewClientWithReader(r io.Reader) (*Client, error) {
+	config, err := newConfigFromReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(config)
+}
+
+func newClient(config *config) (*Client, error) {
+	config.buffers = newBufferPool(config.bufferSize)
 	client := &Client{
 		config:          config,
 		storagePoolLock: &sync.RWMutex{},
+		closed:          new(bool),
+		storeCache:      newStoreCache(config.storeCacheTTL),
+		trackerPools:    &trackerSet{},
+	}
+	client.storagePools = make(map[string]*connPool)
+	client.storageBreakers = make(map[string]*breaker)
+
+	for _, addr := range config.trackerAddr {
+		trackerPool, err := newConnPool(addr, config)
+		if err != nil {
+			client.Destroy()
+			return nil, err
+		}
+		client.trackerPools.pools = append(client.trackerPools.pools, trackerPool)
+	}
+
+	return client, nil
+}
+
+//trackerSet is shared by the clients derived with With, so SetTrackers
+//reaches all of them. pools is replaced, never changed in place
+type trackerSet struct {
+	update sync.Mutex
+	lock   sync.RWMutex
+	pools  []*connPool
+}
+
+func (this *trackerSet) get() []*connPool {
+	if this == nil {
+		return nil
+	}
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.pools
+}
+
+// Deprecated: use Destroy, Destory is kept for existing callers.
+func (this *Client) Destory() {
+	this.Destroy()
+}
+
+// Destroy closes the client at once, aborting the operations in flight.
+// See Shutdown to let them finish.
+func (this *Client) Destroy() {
+	if this == nil {
+		return
+	}
+	for _, pool := range this.closePools() {
+		pool.Destroy()
+	}
+}
+
+// Shutdown stops handing out connections and waits for the borrowed ones to
+// be returned, until ctx is done, then closes all of them.
+func (this *Client) Shutdown(ctx context.Context) error {
+	if this == nil {
+		return nil
+	}
+	var err error
+	for _, pool := range this.closePools() {
+		if poolErr := pool.Close(ctx); poolErr != nil && err == nil {
+			err = poolErr
+		}
+	}
+	return err
+}
+
+//no tracker or storage pool is added once closed
+func (this *Client) closePools() []*connPool {
+	this.storagePoolLock.Lock()
+	*this.closed = true
+	var pools []*connPool
+	for _, pool := range this.storagePools {
+		pools = append(pools, pool)
+	}
+	this.storagePoolLock.Unlock()
+	//after closed is set, a SetTrackers in progress either sees it or has
+	//swapped its pools in already
+	return append(pools, this.trackerPools.get()...)
+}
+
+// SetTrackers replaces the trackers, e.g. after the cluster was scaled, in
+// this client and every one derived from it with With. Pools of trackers
+// still in addrs are kept as they are, those of new ones are dialed, and
+// those of removed ones are closed once their borrowed conns come back. On
+// any error the trackers stay unchanged.
+func (this *Client) SetTrackers(addrs []string) error {
+	if len(addrs) == 0 {
+		return fmt.Errorf("no tracker_server")
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("tracker_server %v", err)
+		}
+	}
+	trackers := this.trackerPools
+	trackers.update.Lock()
+	defer trackers.update.Unlock()
+
+	oldPools := make(map[string]*connPool)
+	for _, pool := range trackers.get() {
+		oldPools[pool.addr] = pool
+	}
+	var pools, newPools []*connPool
+	for _, addr := range addrs {
+		if _, ok := findPool(pools, addr); ok {
+			continue
+		}
+		pool, ok := oldPools[addr]
+		if ok {
+			delete(oldPools, addr)
+		} else {
+			var err error
+			if pool, err = newConnPool(addr, this.config); err != nil {
+				destroyPools(newPools)
+				return err
+			}
+			newPools = append(newPools, pool)
+		}
+		pools = append(pools, pool)
+	}
+
+	trackers.lock.Lock()
+	this.storagePoolLock.RLock()
+	closed := *this.closed
+	this.storagePoolLock.RUnlock()
+	if !closed {
+		trackers.pools = pools
+	}
+	trackers.lock.Unlock()
+	if closed {
+		destroyPools(newPools)
+		return fmt.Errorf("client closed")
+	}
+	for _, pool := range oldPools {
+		pool.Destroy()
+	}
+	return nil
+}
+
+func findPool(pools []*connPool, addr string) (*connPool, bool) {
+	for _, pool := range pools {
+		if pool.addr == addr {
+			return pool, true
+		}
+	}
+	return nil, false
+}
+
+func destroyPools(pools []*connPool) {
+	for _, pool := range pools {
+		pool.Destroy()
+	}
+}
+
+// With derives a client that shares the pools of this one, so it costs no
+// dial, but applies opts on top of its settings, e.g. a strict timeout and no
+// retries for health checks. Options that shape the pools, such as the
+// trackers, maxConns, the buffer size, TLS, the dialer or the conn factory,
+// have no effect on the shared ones. Destroying either client closes the
+// pools of both.
+func (this *Client) With(opts ...Option) *Client {
+	config := *this.config
+	for _, opt := range opts {
+		opt(&config)
+	}
+	//trackerIndex is not copied, getTrackerConn changes it concurrently
+	return &Client{
+		trackerPools:    this.trackerPools,
+		storagePools:    this.storagePools,
+		storageBreakers: this.storageBreakers,
+		storagePoolLock: this.storagePoolLock,
+		closed:          this.closed,
+		storeCache:      this.storeCache,
+		config:          &config,
+	}
+}
+
+// SetNetworkTimeout bounds every send and receive phase of a task, just like
+// network_timeout in the config file. Call it before the client is shared.
+func (this *Client) SetNetworkTimeout(timeout time.Duration) {
+	this.config.networkTimeout = timeout
+}
+
+func (this *Client) PoolStats() map[string]PoolStats {
+	stats := make(map[string]PoolStats)
+	for _, pool := range this.trackerPools.get() {
+		stats[pool.addr] = pool.Stats()
+	}
+	this.storagePoolLock.RLock()
+	for addr, pool := range this.storagePools {
+		stats[addr] = pool.Stats()
+	}
+	//a storage down since its first dial has a breaker but no pool
+	for addr, breaker := range this.storageBreakers {
+		poolStats := stats[addr]
+		poolStats.CircuitOpen = breaker.isOpen()
+		stats[addr] = poolStats
+	}
+	this.storagePoolLock.RUnlock()
+	return stats
+}
+
+// SetStorageMaxConns resizes the pool of the storage at addr, as reported by
+// PoolStats, without restarting the client.
+func (this *Client) SetStorageMaxConns(addr string, maxConns int) error {
+	this.storagePoolLock.RLock()
+	pool, ok := this.storagePools[addr]
+	this.storagePoolLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no storage pool for %s", addr)
+	}
+	return pool.SetMaxConns(maxConns)
+}
+
+// Ping checks one tracker answers, with a single ACTIVE_TEST round trip.
+func (this *Client) Ping() error {
+	timeout := this.config.networkTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_CONNECT_TIMEOUT
+	}
+	return this.withTrackerConn(context.Background(), func(trackerConn net.Conn) error {
+		return activeTest(trackerConn.(pConn).Conn, timeout)
+	})
+}
+
+// ListGroups reports every group the tracker knows, for monitoring.
+func (this *Client) ListGroups() ([]GroupStat, error) {
+	task := &trackerListGroupsTask{}
+	ctx := context.Background()
+	err := this.retry(ctx, func() error {
+		return this.doTracker(ctx, task)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return task.groupStats, nil
+}
+
+// ListStorages reports the storages of groupName, only the one at storageIP
+// unless it is empty.
+func (this *Client) ListStorages(groupName string, storageIP string) ([]StorageStat, error) {
+	if groupName == "" || len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("invalid group name %q", groupName)
+	}
+	task := &trackerListStoragesTask{}
+	//req
+	task.groupName = groupName
+	task.storageIP = storageIP
+
+	ctx := context.Background()
+	err := this.retry(ctx, func() error {
+		return this.doTracker(ctx, task)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return task.storageStats, nil
+}
+
+// DeleteStorage removes a decommissioned storage from the tracker. The
+// tracker only accepts storages it already reports offline, a refusal comes
+// back as a *StatusError, e.g. status 16 (EBUSY) for one still online.
+func (this *Client) DeleteStorage(groupName string, storageIP string) error {
+	if groupName == "" || len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return fmt.Errorf("invalid group name %q", groupName)
+	}
+	if storageIP == "" {
+		return fmt.Errorf("empty storage ip")
+	}
+	task := &trackerDeleteStorageTask{}
+	//req
+	task.groupName = groupName
+	task.storageIP = storageIP
+
+	return this.doTracker(context.Background(), task)
+}
+
+func (this *Client) UploadByFilename(fileName string) (string, error) {
+	return this.UploadByFilenameExt(fileName, "")
+}
+
+func (this *Client) UploadByFilenameContext(ctx context.Context, fileName string) (string, error) {
+	return this.uploadByFilename(ctx, fileName, "")
+}
+
+// UploadByFilenameExt stores fileName with fileExtName, cut to 6 bytes, in
+// place of the extension of fileName, e.g. a temp file "upload-123.tmp" as
+// jpg. An empty fileExtName keeps that of fileName.
+func (this *Client) UploadByFilenameExt(fileName string, fileExtName string) (string, error) {
+	return this.uploadByFilename(context.Background(), fileName, fileExtName)
+}
+
+func (this *Client) uploadByFilename(ctx context.Context, fileName string, fileExtName string) (string, error) {
+	fileInfo, err := newFileInfo(fileName, nil, fileExtName)
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(ctx, task, "", nil)
+}
+
+// UploadByFilenameResult is UploadByFilename that also tells which storage
+// took the file.
+func (this *Client) UploadByFilenameResult(fileName string) (*UploadResult, error) {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileWithResult(context.Background(), task, "", nil)
+}
+
+// UploadByFilenameWithProgress calls progress from the sending goroutine
+// after every chunk of up to 32KB, the last call has sent == total. A retried
+// upload reports from zero again.
+func (this *Client) UploadByFilenameWithProgress(fileName string, progress func(sent, total int64)) (string, error) {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+	fileInfo.progress = progress
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+// UploadBatch uploads fileNames with up to concurrency uploads at a time,
+// and reports each fileId or error at the index of its file.
+func (this *Client) UploadBatch(fileNames []string, concurrency int) ([]string, []error) {
+	fileIds := make([]string, len(fileNames))
+	errs := make([]error, len(fileNames))
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(fileNames); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				fileIds[index], errs[index] = this.UploadByFilename(fileNames[index])
+			}
+		}()
+	}
+	for index := range fileNames {
+		indexes <- index
+	}
+	close(indexes)
+	wg.Wait()
+	return fileIds, errs
+}
+
+func (this *Client) UploadByFilenameToGroup(groupName string, fileName string) (string, error) {
+	if groupName == "" || len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return "", fmt.Errorf("invalid group name %q", groupName)
+	}
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, groupName, nil)
+}
+
+// QueryStorageStore asks the tracker for the storage an upload would go to,
+// in groupName unless it is empty.
+func (this *Client) QueryStorageStore(groupName string) (*StorageInfo, error) {
+	if len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("invalid group name %q", groupName)
+	}
+	var storageInfo *StorageInfo
+	ctx := context.Background()
+	err := this.retry(ctx, func() error {
+		var err error
+		storageInfo, err = this.queryStorageStore(ctx, groupName)
+		return err
+	})
+	return storageInfo, err
+}
+
+// QueryStorageUpdate asks the tracker for the storage that accepts changes
+// to fileId, such as append, modify, metadata and delete.
+func (this *Client) QueryStorageUpdate(fileId string) (*StorageInfo, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	var storageInfo *StorageInfo
+	ctx := context.Background()
+	err = this.retry(ctx, func() error {
+		var err error
+		storageInfo, err = this.queryStorageUpdate(ctx, groupName, remoteFilename)
+		return err
+	})
+	return storageInfo, err
+}
+
+// QueryStorages lists every storage holding fileId, the tracker's preferred
+// one first.
+func (this *Client) QueryStorages(fileId string) ([]StorageInfo, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	var storageInfos []StorageInfo
+	ctx := context.Background()
+	err = this.retry(ctx, func() error {
+		var err error
+		storageInfos, err = this.queryAllStorageInfoWithTracker(ctx, groupName, remoteFilename)
+		return err
+	})
+	return storageInfos, err
+}
+
+// UploadSlaveByFilename stores fileName next to the master file, named after
+// the master with prefixName inserted before the extension.
+func (this *Client) UploadSlaveByFilename(masterFileId string, prefixName string, fileName string) (string, error) {
+	if prefixName == "" || len(prefixName) > FDFS_FILE_PREFIX_MAX_LEN {
+		return "", fmt.Errorf("invalid prefix name %q", prefixName)
+	}
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+	groupName, masterFilename, err := splitFileId(masterFileId)
+	if err != nil {
+		return "", err
+	}
+
+	if err := this.checkFileInfo(fileInfo); err != nil {
+		return "", err
+	}
+	this.defaultFileExtName(fileInfo)
+	task := &storageUploadSlaveTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.masterFilename = masterFilename
+	task.prefixName = prefixName
+
+	ctx, cancel := withDefaultTimeout(context.Background(), this.config.uploadTimeout)
+	defer cancel()
+	start := time.Now()
+	err = this.retry(ctx, func() error {
+		//the slave has to land on the storage holding the master
+		storageInfo, err := this.queryStorageUpdate(ctx, groupName, masterFilename)
+		if err != nil {
+			return err
+		}
+		if err = this.doStorage(ctx, task, storageInfo); err != nil {
+			if rewindErr := task.fileInfo.rewind(); rewindErr != nil {
+				return finalError{err}
+			}
+		}
+		return err
+	})
+	this.config.getMetrics().ObserveUpload(fileInfo.fileSize, time.Since(start), err)
+	if err != nil {
+		return "", err
+	}
+	return task.fileId, nil
+}
+
+// UploadByFilenameWithMeta sets meta on the same storage right after the
+// upload. The file id is only returned once the metadata is stored; if setting
+// it fails the uploaded file is deleted again and the error is returned.
+func (this *Client) UploadByFilenameWithMeta(fileName string, meta map[string]string) (string, error) {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, "", meta)
+}
+
+// UploadByFilenameToPath stores fileName on store path pathIndex of the
+// storage the tracker picks, e.g. to keep a file on SSD rather than HDD. An
+// index past the store path count the tracker lists for the group fails
+// before the upload. When the tracker can't list the groups the check is
+// skipped, and a bad index is left to the storage to refuse.
+func (this *Client) UploadByFilenameToPath(fileName string, pathIndex uint8) (string, error) {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.storagePathIndex = int8(pathIndex)
+	task.pinnedPathIndex = true
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+func (this *Client) UploadAppenderByFilename(fileName string) (string, error) {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.appender = true
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+func (this *Client) UploadByBuffer(buffer []byte, fileExtName string) (string, error) {
+	fileInfo, err := newFileInfo("", buffer, fileExtName)
+	defer fileInfo.Close()
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+// UploadFromFile uploads the whole of an open file, e.g. a multipart temp
+// file, without closing it.
+func (this *Client) UploadFromFile(file *os.File, fileExtName string) (string, error) {
+	fileInfo, err := newFileInfoFromFile(file, fileExtName)
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+// UploadByBufferResult is UploadByBuffer returning the UploadResult.
+func (this *Client) UploadByBufferResult(buffer []byte, fileExtName string) (*UploadResult, error) {
+	fileInfo, err := newFileInfo("", buffer, fileExtName)
+	if err != nil {
+		return nil, err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileWithResult(context.Background(), task, "", nil)
+}
+
+// UploadByBufferWithCrc32 is UploadByBuffer for a caller that already
+// hashed buffer with crc32.ChecksumIEEE. The size and crc32 the storage
+// recorded for the file must match, otherwise the file is deleted again and
+// an error returned.
+func (this *Client) UploadByBufferWithCrc32(buffer []byte, fileExtName string, expectedCrc32 uint32) (string, error) {
+	fileId, err := this.UploadByBuffer(buffer, fileExtName)
+	if err != nil {
+		return "", err
+	}
+	//decoded from the fileId, asked from the storage if it can't be
+	fileDetail, err := this.GetFileInfo(fileId)
+	if err == nil && (fileDetail.FileSize != int64(len(buffer)) || fileDetail.Crc32 != expectedCrc32) {
+		err = fmt.Errorf("upload %s size %d crc32 %08x != size %d crc32 %08x",
+			fileId, fileDetail.FileSize, fileDetail.Crc32, len(buffer), expectedCrc32)
+	}
+	if err != nil {
+		if deleteErr := this.DeleteFile(fileId); deleteErr != nil {
+			this.config.getLogger().Warnf("fdfs: delete unverified upload %s: %v", fileId, deleteErr)
+		}
+		return "", err
+	}
+	return fileId, nil
+}
+
+func (this *Client) UploadByReader(reader io.Reader, size int64, fileExtName string) (string, error) {
+	fileInfo, err := newFileInfoFromReader(reader, size, fileExtName)
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+
+	return this.uploadFileToStorage(context.Background(), task, "", nil)
+}
+
+// Upload stores src by its type: a string is the path of a local file, with
+// its own extension if fileExtName is empty, a []byte is uploaded as
+// UploadByBuffer, and an io.Reader must tell its size, as *os.File,
+// *bytes.Reader, *strings.Reader and *io.SectionReader do. Only what is left
+// past its current offset is uploaded. See the specific Upload* methods for
+// anything more.
+func (this *Client) Upload(src interface{}, fileExtName string) (string, error) {
+	switch src := src.(type) {
+	case string:
+		return this.UploadByFilenameExt(src, fileExtName)
+	case []byte:
+		return this.UploadByBuffer(src, fileExtName)
+	case *os.File:
+		return this.UploadFromFile(src, fileExtName)
+	case interface {
+		io.Reader
+		Size() int64
+	}:
+		//Size of a bytes or strings reader is the whole, Len is what is left
+		if lener, ok := src.(interface{ Len() int }); ok {
+			return this.UploadByReader(src, int64(lener.Len()), fileExtName)
+		}
+		//a section reader has no Len, its offset tells what was read
+		if seeker, ok := src.(io.Seeker); ok {
+			offset, err := seeker.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return "", err
+			}
+			return this.UploadByReader(src, src.Size()-offset, fileExtName)
+		}
+		return "", fmt.Errorf("upload %T of unknown remaining size, use UploadByReader", src)
+	case io.Reader:
+		return "", fmt.Errorf("upload %T of unknown size, use UploadByReader", src)
+	}
+	return "", fmt.Errorf("upload of unsupported %T", src)
+}
+
+// AppendByFilename is not retried, since a lost response would otherwise
+// append the content twice.
+func (this *Client) AppendByFilename(fileId string, fileName string) error {
+	fileInfo, err := newFileInfo(fileName, nil, "")
+	defer fileInfo.Close()
+	if err != nil {
+		return err
+	}
+	return this.appendFileInfo(fileId, fileInfo)
+}
+
+func (this *Client) appendFileInfo(fileId string, fileInfo *fileInfo) error {
+	if err := this.checkFileInfo(fileInfo); err != nil {
+		return err
+	}
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return err
+	}
+	storageInfo, err := this.queryStorageUpdate(context.Background(), groupName, remoteFilename)
+	if err != nil {
+		return err
+	}
+
+	task := &storageAppendTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.remoteFilename = remoteFilename
+
+	return this.doStorage(context.Background(), task, storageInfo)
+}
+
+func (this *Client) ModifyByBuffer(fileId string, offset int64, buffer []byte) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid modify offset %d", offset)
+	}
+	if len(buffer) == 0 {
+		return fmt.Errorf("modify buffer is empty")
+	}
+	fileInfo, err := newFileInfo("", buffer, "")
+	if err != nil {
+		return err
+	}
+	return this.modifyFileInfo(fileId, offset, fileInfo)
+}
+
+//modifying the same range again is harmless, so unlike append it is retried
+func (this *Client) modifyFileInfo(fileId string, offset int64, fileInfo *fileInfo) error {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return err
+	}
+
+	task := &storageModifyTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.remoteFilename = remoteFilename
+	task.fileOffset = offset
+
+	ctx := context.Background()
+	return this.retry(ctx, func() error {
+		storageInfo, err := this.queryStorageUpdate(ctx, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		if err = this.doStorage(ctx, task, storageInfo); err != nil {
+			if rewindErr := task.fileInfo.rewind(); rewindErr != nil {
+				return finalError{err}
+			}
+		}
+		return err
+	})
+}
+
+// UploadLargeFile uploads a file bigger than chunkSize as an appender file,
+// writing its chunks with up to concurrency modifies in parallel. A storage
+// only modifies within the current size, so the file is first grown by
+// appending zeros past the first chunk, which sends that part twice: pick it
+// only when one connection can't fill the link. With concurrency 1 the
+// chunks are appended in order instead. Smaller files take the normal upload.
+func (this *Client) UploadLargeFile(fileName string, chunkSize int64, concurrency int) (string, error) {
+	if chunkSize <= 0 {
+		return "", fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	fileSize := stat.Size()
+	if fileSize <= chunkSize {
+		return this.UploadByFilename(fileName)
+	}
+	//each chunk alone would pass
+	if err := this.checkFileSize(fileSize); err != nil {
+		return "", err
+	}
+
+	fileInfo, err := newFileInfoFromReader(io.NewSectionReader(file, 0, chunkSize), chunkSize, fileExtNameOf(fileName))
+	if err != nil {
+		return "", err
+	}
+	task := &storageUploadTask{}
+	//req
+	task.fileInfo = fileInfo
+	task.appender = true
+
+	fileId, err := this.uploadFileToStorage(context.Background(), task, "", nil)
+	if err != nil {
+		return "", err
+	}
+	if err := this.writeChunks(fileId, file, fileSize, chunkSize, concurrency); err != nil {
+		//best effort, the partial file is of no use
+		this.DeleteFile(fileId)
+		return "", err
+	}
+	return fileId, nil
+}
+
+//writes all but the first chunk, which the appender upload already holds
+func (this *Client) writeChunks(fileId string, file *os.File, fileSize int64, chunkSize int64, concurrency int) error {
+	chunk := func(offset int64) (*fileInfo, error) {
+		size := chunkSize
+		if fileSize-offset < size {
+			size = fileSize - offset
+		}
+		return newFileInfoFromReader(io.NewSectionReader(file, offset, size), size, "")
+	}
+
+	if concurrency <= 1 {
+		for offset := chunkSize; offset < fileSize; offset += chunkSize {
+			fileInfo, err := chunk(offset)
+			if err != nil {
+				return err
+			}
+			if err := this.appendFileInfo(fileId, fileInfo); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//grown first, the chunks can then land in any order
+	placeholder, err := newFileInfoFromReader(io.LimitReader(zeroReader{}, fileSize-chunkSize), fileSize-chunkSize, "")
+	if err != nil {
+		return err
+	}
+	if err := this.appendFileInfo(fileId, placeholder); err != nil {
+		return err
+	}
+
+	offsets := make(chan int64)
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				fileInfo, err := chunk(offset)
+				if err == nil {
+					err = this.modifyFileInfo(fileId, offset, fileInfo)
+				}
+				if err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for offset := chunkSize; offset < fileSize; offset += chunkSize {
+		lock.Lock()
+		failed := firstErr != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+		offsets <- offset
+	}
+	close(offsets)
+	wg.Wait()
+	return firstErr
+}
+
+// RegenerateAppenderFile turns a finished appender file into a normal one
+// and returns its new fileId. It is not retried, a lost response would leave
+// the first attempt done and the next one failing.
+func (this *Client) RegenerateAppenderFile(fileId string) (string, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return "", err
+	}
+	storageInfo, err := this.queryStorageUpdate(context.Background(), groupName, remoteFilename)
+	if err != nil {
+		return "", err
+	}
+
+	task := &storageRegenerateAppenderTask{}
+	//req
+	task.appenderFilename = remoteFilename
+
+	if err := this.doStorage(context.Background(), task, storageInfo); err != nil {
+		return "", err
+	}
+	return task.fileId, nil
+}
+
+func (this *Client) TruncateFile(fileId string, truncatedSize int64) error {
+	if truncatedSize < 0 {
+		return fmt.Errorf("invalid truncated size %d", truncatedSize)
+	}
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return err
+	}
+
+	task := &storageTruncateTask{}
+	//req
+	task.remoteFilename = remoteFilename
+	task.truncatedSize = truncatedSize
+
+	return this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE, groupName, remoteFilename, task)
+}
+
+func (this *Client) GetFileInfo(fileId string) (*FileDetail, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	fileDetail, ok, err := decodeFileDetail(remoteFilename)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return fileDetail, nil
+	}
+
+	task := &storageQueryFileInfoTask{}
+	//req
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
+
+	if err := this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename, task); err != nil {
+		return nil, err
+	}
+	return &task.fileDetail, nil
+}
+
+// FileExists asks the storage for the file info, it reports false with no
+// error for a file the tracker or storage doesn't know. Unlike GetFileInfo it
+// always goes to the server, the detail encoded in the name says nothing
+// about a deleted file.
+func (this *Client) FileExists(fileId string) (bool, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return false, err
+	}
+	task := &storageQueryFileInfoTask{}
+	//req
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
+
+	err = this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename, task)
+	if errors.Is(err, ErrFileNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetMetadata replaces the file metadata with flag STORAGE_SET_METADATA_FLAG_OVERWRITE
+// or merges into it with STORAGE_SET_METADATA_FLAG_MERGE.
+func (this *Client) SetMetadata(fileId string, meta map[string]string, flag byte) error {
+	if flag != STORAGE_SET_METADATA_FLAG_OVERWRITE && flag != STORAGE_SET_METADATA_FLAG_MERGE {
+		return fmt.Errorf("invalid set metadata flag %q", flag)
+	}
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return err
+	}
+
+	task := &storageSetMetadataTask{}
+	//req
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
+	task.metaBuffer = packMetadata(meta)
+	task.flag = flag
+
+	return this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE, groupName, remoteFilename, task)
+}
+
+func (this *Client) GetMetadata(fileId string) (map[string]string, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+
+	task := &storageGetMetadataTask{}
+	//req
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
+
+	if err := this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename, task); err != nil {
+		return nil, err
+	}
+	return task.meta, nil
+}
+
+// Locate asks the tracker once for the storage to fetch fileId from, for a
+// series of operations on the file. The storage stays the same until the
+// Location is dropped, so keep it short-lived.
+func (this *Client) Locate(fileId string) (*Location, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return nil, err
+	}
+	var storageInfo *StorageInfo
+	ctx := context.Background()
+	err = this.retry(ctx, func() error {
+		var err error
+		storageInfo, err = this.queryStorageInfoWithTracker(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Location{
+		FileId:  FileId{GroupName: groupName, RemoteFilename: remoteFilename},
+		Storage: *storageInfo,
+	}, nil
+}
+
+// GetMetadataFromLocation is GetMetadata on the located storage.
+func (this *Client) GetMetadataFromLocation(location *Location) (map[string]string, error) {
+	task := &storageGetMetadataTask{}
+	//req
+	task.groupName = location.FileId.GroupName
+	task.remoteFilename = location.FileId.RemoteFilename
+
+	ctx := context.Background()
+	err := this.retry(ctx, func() error {
+		return this.doStorage(ctx, task, &location.Storage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return task.meta, nil
+}
+
+// DownloadFromLocation is DownloadToWriter on the located storage, with no
+// fallback to the other replicas.
+func (this *Client) DownloadFromLocation(location *Location, writer io.Writer) (int64, error) {
+	task := &storageDownloadTask{}
+	//req
+	task.groupName = location.FileId.GroupName
+	task.remoteFilename = location.FileId.RemoteFilename
+	//res
+	task.writer = writer
+
+	ctx, cancel := withDefaultTimeout(context.Background(), this.config.downloadTimeout)
+	defer cancel()
+	start := time.Now()
+	err := this.retry(ctx, func() error {
+		err := this.doStorage(ctx, task, &location.Storage)
+		if err != nil && task.recvBytes > 0 {
+			//bytes already handed to the writer can't be taken back
+			return finalError{err}
+		}
+		return err
+	})
+	this.config.getMetrics().ObserveDownload(task.recvBytes, time.Since(start), err)
+	return task.recvBytes, err
+}
+
+func (this *Client) DownloadToFile(fileId string, localFilename string, offset int64, downloadBytes int64) error {
+	return this.DownloadToFileContext(context.Background(), fileId, localFilename, offset, downloadBytes)
+}
+
+func (this *Client) DownloadToFileContext(ctx context.Context, fileId string, localFilename string, offset int64, downloadBytes int64) error {
+	task := &storageDownloadTask{}
+	//res
+	task.localFilename = localFilename
+
+	return this.downloadFileFromStorage(ctx, task, fileId, offset, downloadBytes)
+}
+
+// DownloadToFileResult is DownloadToFile that also reports where the file
+// went and how many bytes were written, sparing the caller a stat.
+func (this *Client) DownloadToFileResult(fileId string, localFilename string, offset int64, downloadBytes int64) (*DownloadResult, error) {
+	absFilename, err := filepath.Abs(localFilename)
+	if err != nil {
+		return nil, err
+	}
+	task := &storageDownloadTask{}
+	//res
+	task.localFilename = absFilename
+
+	if err := this.downloadFileFromStorage(context.Background(), task, fileId, offset, downloadBytes); err != nil {
+		return nil, err
+	}
+	return &DownloadResult{LocalFilename: absFilename, Size: task.recvBytes}, nil
+}
+
+// DownloadToFileWithProgress calls progress after every chunk received with
+// the running count and the size the storage announced.
+func (this *Client) DownloadToFileWithProgress(fileId string, localFilename string, progress func(received, total int64)) error {
+	task := &storageDownloadTask{}
+	//res
+	task.localFilename = localFilename
+	task.progress = progress
+
+	return this.downloadFileFromStorage(context.Background(), task, fileId, 0, 0)
+}
+
+// DownloadToFileVerified checks the crc32 of the received content against
+// the one the storage recorded, which is decoded from the fileId for normal
+// files and queried from the storage otherwise.
+func (this *Client) DownloadToFileVerified(fileId string, localFilename string) error {
+	fileDetail, err := this.GetFileInfo(fileId)
+	if err != nil {
+		return err
+	}
+	task := &storageDownloadTask{}
+	//res
+	task.localFilename = localFilename
+	task.crc32 = crc32.NewIEEE()
+	//checked before the file is renamed into place
+	task.expectedCrc32 = fileDetail.Crc32
+
+	return this.downloadFileFromStorage(context.Background(), task, fileId, 0, 0)
+}
+
+// DownloadToBuffer holds the whole downloaded range in memory, so prefer
+// DownloadToFile for large files. downloadBytes 0 means up to the end of file.
+func (this *Client) DownloadToBuffer(fileId string, offset int64, downloadBytes int64) ([]byte, error) {
+	task := &storageDownloadTask{}
+	if err := this.downloadFileFromStorage(context.Background(), task, fileId, offset, downloadBytes); err != nil {
+		return nil, err
+	}
+	return task.buffer, nil
+}
+
+// DownloadResume continues a download cut off earlier: it appends to
+// localFilename only what is past its current size, then checks the size,
+// and for a normal file the crc32, of the whole file against the storage's.
+// Call it again after an error to go on from where it stopped. A local file
+// that fails the check is removed, so the next call starts over.
+func (this *Client) DownloadResume(fileId string, localFilename string) error {
+	fileDetail, err := this.GetFileInfo(fileId)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(localFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
 	}
-	client.trackerPools = make(map[string]*connPool)
-	client.storagePools = make(map[string]*connPool)
+	if offset := stat.Size(); offset < fileDetail.FileSize {
+		writer := bufio.NewWriter(file)
+		task := &storageDownloadTask{}
+		//res
+		task.writer = writer
 
-	for _, addr := range config.trackerAddr {
-		trackerPool, err := newConnPool(addr, config.maxConns)
+		err = this.downloadFileFromStorage(context.Background(), task, fileId, offset, fileDetail.FileSize-offset)
+		//keep what arrived for the next call
+		if flushErr := writer.Flush(); err == nil {
+			err = flushErr
+		}
 		if err != nil {
-			return nil, err
+			return err
 		}
-		client.trackerPools[addr] = trackerPool
 	}
-
-	return client, nil
+	if err := file.Close(); err != nil {
+		return err
+	}
+	//an appender file has no crc32 once it changed
+	_, remoteFilename, _ := splitFileId(fileId)
+	_, checkCrc32, _ := decodeFileDetail(remoteFilename)
+	if err := checkLocalFile(localFilename, fileDetail, checkCrc32); err != nil {
+		os.Remove(localFilename)
+		return fmt.Errorf("resume %s: %v", fileId, err)
+	}
+	return nil
 }
 
-
-func NewClientWithConfig(configName string) (*Client, error) {
-	config, err := newConfig(configName)
+//size and crc32 of a downloaded file against the storage's
+func checkLocalFile(localFilename string, fileDetail *FileDetail, checkCrc32 bool) error {
+	file, err := os.Open(localFilename)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	client := &Client{
-		config:          config,
-		storagePoolLock: &sync.RWMutex{},
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
 	}
-	client.trackerPools = make(map[string]*connPool)
-	client.storagePools = make(map[string]*connPool)
-
-	for _, addr := range config.trackerAddr {
-		trackerPool, err := newConnPool(addr, config.maxConns)
-		if err != nil {
-			return nil, err
-		}
-		client.trackerPools[addr] = trackerPool
+	if size != fileDetail.FileSize || (checkCrc32 && hash.Sum32() != fileDetail.Crc32) {
+		return fmt.Errorf("local size %d crc32 %08x != size %d crc32 %08x", size, hash.Sum32(), fileDetail.FileSize, fileDetail.Crc32)
 	}
-
-	return client, nil
+	return nil
 }
 
-func (this *Client) Destory() {
-	if this == nil {
-		return
+// DownloadHead fetches only the first n bytes of the file, e.g. to sniff its
+// content type. A file shorter than n comes back whole, so the result may be
+// shorter than n.
+func (this *Client) DownloadHead(fileId string, n int64) ([]byte, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid head length %d", n)
+	}
+	//the storage refuses a range past the end of file
+	fileDetail, err := this.GetFileInfo(fileId)
+	if err != nil {
+		return nil, err
 	}
-	for _, pool := range this.trackerPools {
-		pool.Destory()
+	if fileDetail.FileSize < n {
+		n = fileDetail.FileSize
 	}
-	for _, pool := range this.storagePools {
-		pool.Destory()
+	if n == 0 {
+		return []byte{}, nil
 	}
+	return this.DownloadToBuffer(fileId, 0, n)
 }
 
-func (this *Client) UploadByFilename(fileName string) (string, error) {
-	fileInfo, err := newFileInfo(fileName, nil, "")
-	defer fileInfo.Close()
-	if err != nil {
-		return "", err
+func (this *Client) DownloadToWriter(fileId string, writer io.Writer) (int64, error) {
+	task := &storageDownloadTask{}
+	//res
+	task.writer = writer
+
+	err := this.downloadFileFromStorage(context.Background(), task, fileId, 0, 0)
+	return task.recvBytes, err
+}
+
+// DownloadRangeToWriter copies length bytes from offset of the file to
+// writer, e.g. to serve an HTTP Range request. length 0 means up to the end
+// of file.
+func (this *Client) DownloadRangeToWriter(fileId string, offset int64, length int64, writer io.Writer) (int64, error) {
+	if offset < 0 || length < 0 {
+		return 0, fmt.Errorf("invalid range offset %d length %d", offset, length)
 	}
+	task := &storageDownloadTask{}
+	//res
+	task.writer = writer
+
+	err := this.downloadFileFromStorage(context.Background(), task, fileId, offset, length)
+	return task.recvBytes, err
+}
 
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, "", "")
+// Open starts a download and returns the file content as a stream read
+// straight off the storage conn, e.g. for http.ServeContent. Close it to give
+// the conn back; closing before EOF drops the conn instead.
+func (this *Client) Open(fileId string) (io.ReadCloser, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	task := &storageUploadTask{}
+	task := &storageDownloadTask{}
 	//req
-	task.fileInfo = fileInfo
-	task.storagePathIndex = storageInfo.storagePathIndex
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
 
-	if err := this.doStorage(task, storageInfo); err != nil {
-		return "", err
+	var reader *fileReader
+	ctx := context.Background()
+	err = this.retry(ctx, func() error {
+		storageInfos, err := this.queryAllStorageInfoWithTracker(ctx, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		for i := range storageInfos {
+			reader, err = this.openFromStorage(task, &storageInfos[i])
+			if err == nil || !isRetryable(err) {
+				return err
+			}
+			this.config.getLogger().Warnf("fdfs: open on %s failed: %v", storageInfos[i].Addr, err)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	return task.fileId, nil
+	return reader, nil
 }
 
-func (this *Client) UploadByBuffer(buffer []byte, fileExtName string) (string, error) {
-	fileInfo, err := newFileInfo("", buffer, fileExtName)
-	defer fileInfo.Close()
+//sends the download request and reads only the header, the body is left
+//on the conn for the returned reader
+func (this *Client) openFromStorage(task *storageDownloadTask, storageInfo *StorageInfo) (*fileReader, error) {
+	conn, err := this.getStorageConn(storageInfo)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	timeout := this.config.networkTimeout
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	err = task.SendReq(conn)
+	if err == nil {
+		err = task.RecvHeader(conn)
 	}
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, "", "")
 	if err != nil {
-		return "", err
+		if timeout > 0 {
+			conn.SetDeadline(time.Time{})
+		}
+		releaseConn(conn, err)
+		return nil, err
 	}
+	return &fileReader{conn: conn, remaining: task.pkgLen, timeout: timeout}, nil
+}
 
-	task := &storageUploadTask{}
-	//req
-	task.fileInfo = fileInfo
-	task.storagePathIndex = storageInfo.storagePathIndex
+func (this *Client) DownloadToAllocatedBuffer(fileId string, buffer []byte,offset int64, downloadBytes int64) (error) {
+	task := &storageDownloadTask{}
+	//res
+	task.buffer = buffer					//allocate buffer by user
 
-	if err := this.doStorage(task, storageInfo); err != nil {
-		return "", err
-	}
-	return task.fileId, nil
+	return this.downloadFileFromStorage(context.Background(), task, fileId, offset, downloadBytes)
 }
 
-func (this *Client) DownloadToFile(fileId string, localFilename string, offset int64, downloadBytes int64) error {
+func (this *Client) DeleteFile(fileId string) error {
 	groupName, remoteFilename, err := splitFileId(fileId)
 	if err != nil {
 		return err
 	}
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename)
-	if err != nil {
-		return err
-	}
 
-	task := &storageDownloadTask{}
+	task := &storageDeleteTask{}
 	//req
 	task.groupName = groupName
 	task.remoteFilename = remoteFilename
-	task.offset = offset
-	task.downloadBytes = downloadBytes
 
-	//res
-	task.localFilename = localFilename
-
-	return this.doStorage(task, storageInfo)
+	return this.doStorageWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE, groupName, remoteFilename, task)
 }
 
-//deprecated
-func (this *Client) DownloadToBuffer(fileId string, offset int64, downloadBytes int64) ([]byte, error) {
-	groupName, remoteFilename, err := splitFileId(fileId)
+func (this *Client) uploadFileToStorage(ctx context.Context, task *storageUploadTask, groupName string, meta map[string]string) (string, error) {
+	result, err := this.uploadFileWithResult(ctx, task, groupName, meta)
 	if err != nil {
+		return "", err
+	}
+	return result.FileId.String(), nil
+}
+
+func (this *Client) uploadFileWithResult(ctx context.Context, task *storageUploadTask, groupName string, meta map[string]string) (*UploadResult, error) {
+	if err := this.checkFileInfo(task.fileInfo); err != nil {
 		return nil, err
 	}
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename)
+	ctx, cancel := withDefaultTimeout(ctx, this.config.uploadTimeout)
+	defer cancel()
+	this.defaultFileExtName(task.fileInfo)
+	var storageInfo *StorageInfo
+	start := time.Now()
+	//a pinned index is checked once per group, not on every retry
+	var checkedGroup string
+	//the tracker may hand out another storage on each retry
+	err := this.retry(ctx, func() error {
+		var err error
+		storageInfo, err = this.queryStorageStore(ctx, groupName)
+		if err != nil {
+			return err
+		}
+		if !task.pinnedPathIndex {
+			task.storagePathIndex = storageInfo.StorePathIndex
+		} else if storageInfo.GroupName != checkedGroup {
+			if err = this.checkStorePathIndex(ctx, storageInfo.GroupName, task.storagePathIndex); err != nil {
+				return finalError{err}
+			}
+			checkedGroup = storageInfo.GroupName
+		}
+		if err = this.doStorage(ctx, task, storageInfo); err != nil {
+			this.storeCache.invalidate(groupName, storageInfo.Addr)
+			if rewindErr := task.fileInfo.rewind(); rewindErr != nil {
+				return finalError{err}
+			}
+		}
+		return err
+	})
+	this.config.getMetrics().ObserveUpload(task.fileInfo.fileSize, time.Since(start), err)
 	if err != nil {
 		return nil, err
 	}
+	result := &UploadResult{
+		FileId:         FileId{GroupName: task.groupName, RemoteFilename: task.remoteFilename},
+		StorageAddr:    storageInfo.Addr,
+		StorePathIndex: task.storagePathIndex,
+		Size:           task.fileInfo.fileSize,
+	}
+	if fileDetail, ok, _ := decodeFileDetail(task.remoteFilename); ok {
+		result.Size = fileDetail.FileSize
+		result.Crc32 = fileDetail.Crc32
+	}
+	if len(meta) == 0 {
+		return result, nil
+	}
 
-	task := &storageDownloadTask{}
+	metaTask := &storageSetMetadataTask{}
 	//req
-	task.groupName = groupName
-	task.remoteFilename = remoteFilename
-	task.offset = offset
-	task.downloadBytes = downloadBytes
+	metaTask.groupName = task.groupName
+	metaTask.remoteFilename = task.remoteFilename
+	metaTask.metaBuffer = packMetadata(meta)
+	metaTask.flag = STORAGE_SET_METADATA_FLAG_OVERWRITE
 
-	//res
-	if err := this.doStorage(task, storageInfo); err != nil {
+	if err := this.doStorage(ctx, metaTask, storageInfo); err != nil {
+		deleteTask := &storageDeleteTask{}
+		deleteTask.groupName = task.groupName
+		deleteTask.remoteFilename = task.remoteFilename
+		this.doStorage(ctx, deleteTask, storageInfo)
 		return nil, err
 	}
-	return task.buffer, nil
+	return result, nil
 }
 
-func (this *Client) DownloadToAllocatedBuffer(fileId string, buffer []byte,offset int64, downloadBytes int64) (error) {
-	groupName, remoteFilename, err := splitFileId(fileId)
-	if err != nil {
+//against the store path count of the group, when the tracker lists it. The
+//storage refuses a bad index anyway, only with a bare EINVAL
+func (this *Client) checkStorePathIndex(ctx context.Context, groupName string, storagePathIndex int8) error {
+	task := &trackerListGroupsTask{}
+	if err := this.doTracker(ctx, task); err != nil {
+		this.config.getLogger().Debugf("fdfs: store path count of %s unknown: %v", groupName, err)
+		return nil
+	}
+	for _, groupStat := range task.groupStats {
+		if groupStat.GroupName == groupName && int64(uint8(storagePathIndex)) >= groupStat.StorePathCount {
+			return fmt.Errorf("store path index %d out of the %d of %s", uint8(storagePathIndex), groupStat.StorePathCount, groupName)
+		}
+	}
+	return nil
+}
+
+//empty files are refused unless allow_empty_file, empty buffers and readers
+//are the caller's explicit choice. Anything over max_file_size is refused
+//before a byte is sent
+func (this *Client) checkFileInfo(fileInfo *fileInfo) error {
+	if fileInfo.file != nil && fileInfo.fileSize == 0 && !this.config.allowEmptyFile {
+		return fmt.Errorf("file %q size is zero", fileInfo.file.Name())
+	}
+	return this.checkFileSize(fileInfo.fileSize)
+}
+
+func (this *Client) checkFileSize(fileSize int64) error {
+	if this.config.maxFileSize > 0 && fileSize > this.config.maxFileSize {
+		return fmt.Errorf("size %d > max_file_size %d: %w", fileSize, this.config.maxFileSize, ErrFileTooLarge)
+	}
+	return nil
+}
+
+//uploads without an extension get default_ext_name, if configured
+func (this *Client) defaultFileExtName(fileInfo *fileInfo) {
+	if fileInfo.fileExtName == "" {
+		fileInfo.fileExtName = clampFileExtName(this.config.defaultExtName)
+	}
+}
+
+func (this *Client) downloadFileFromStorage(ctx context.Context, task *storageDownloadTask, fileId string, offset int64, downloadBytes int64) error {
+	ctx, cancel := withDefaultTimeout(ctx, this.config.downloadTimeout)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename)
+	groupName, remoteFilename, err := splitFileId(fileId)
 	if err != nil {
 		return err
 	}
 
-	task := &storageDownloadTask{}
 	//req
 	task.groupName = groupName
 	task.remoteFilename = remoteFilename
 	task.offset = offset
 	task.downloadBytes = downloadBytes
-	task.buffer = buffer					//allocate buffer by user
+	task.dirPerm = this.config.getDownloadDirPerm()
+	task.inPlace = this.config.downloadInPlace
+	task.overwrite = this.config.overwritePolicy
+	if task.localFilename != "" && task.overwrite != OverwriteFile {
+		if _, err := os.Lstat(task.localFilename); err == nil {
+			if task.overwrite == SkipIfExists {
+				return nil
+			}
+			return fmt.Errorf("%s %w", task.localFilename, ErrFileExists)
+		}
+	}
 
-	//res
-	if err := this.doStorage(task, storageInfo); err != nil {
+	start := time.Now()
+	err = this.retry(ctx, func() error {
+		storageInfos, err := this.queryAllStorageInfoWithTracker(ctx, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		//the tracker's pick comes first, the other replicas cover for it
+		for i := range storageInfos {
+			err = this.doStorage(ctx, task, &storageInfos[i])
+			if err != nil && task.writer != nil && task.recvBytes > 0 {
+				//bytes already handed to the writer can't be taken back
+				return finalError{err}
+			}
+			if errors.Is(err, ErrFileExists) {
+				return finalError{err}
+			}
+			if err == nil || !isRetryable(err) || ctx.Err() != nil {
+				return err
+			}
+			this.config.getLogger().Warnf("fdfs: download from %s failed: %v", storageInfos[i].Addr, err)
+		}
 		return err
+	})
+	this.config.getMetrics().ObserveDownload(task.recvBytes, time.Since(start), err)
+	if task.overwrite == SkipIfExists && errors.Is(err, ErrFileExists) {
+		//created by someone else while downloading
+		return nil
 	}
-	return nil
+	return err
 }
 
-func (this *Client) DeleteFile(fileId string) error {
-	groupName, remoteFilename, err := splitFileId(fileId)
-	if err != nil {
-		return err
-	}
-	storageInfo, err := this.queryStorageInfoWithTracker(TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, groupName, remoteFilename)
-	if err != nil {
-		return err
+//bounds a whole operation by timeout, unless ctx already has a deadline
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+		return ctx, func() {}
 	}
+	return context.WithTimeout(ctx, timeout)
+}
 
-	task := &storageDeleteTask{}
-	//req
-	task.groupName = groupName
-	task.remoteFilename = remoteFilename
+// doStorageWithTracker resolves the storage with cmd and runs task there,
+// retrying both steps on transport errors.
+func (this *Client) doStorageWithTracker(ctx context.Context, cmd int8, groupName string, remoteFilename string, task task) error {
+	return this.retry(ctx, func() error {
+		storageInfo, err := this.queryStorageInfoWithTracker(ctx, cmd, groupName, remoteFilename)
+		if err != nil {
+			return err
+		}
+		return this.doStorage(ctx, task, storageInfo)
+	})
+}
+
+// finalError stops retry at once and is unwrapped before being returned.
+type finalError struct {
+	error
+}
+
+// retry runs fn until it succeeds, fails with a non retryable error, or
+// max_retries is used up, sleeping retry_interval between attempts.
+func (this *Client) retry(ctx context.Context, fn func() error) error {
+	interval := this.config.retryInterval
+	for retry := 0; ; retry++ {
+		err := fn()
+		if final, ok := err.(finalError); ok {
+			return final.error
+		}
+		if err == nil || retry >= this.config.maxRetries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		this.config.getLogger().Infof("fdfs: retry %d/%d after %v: %v", retry+1, this.config.maxRetries, interval, err)
+		if interval <= 0 {
+			continue
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if this.config.retryBackoff {
+			interval *= 2
+		}
+	}
+}
 
-	return this.doStorage(task, storageInfo)
+// doTracker runs tasks in order on one tracker connection, stopping at the
+// first error.
+func (this *Client) doTracker(ctx context.Context, tasks ...task) error {
+	return this.withTrackerConn(ctx, func(trackerConn net.Conn) error {
+		for _, task := range tasks {
+			if err := runTask(ctx, trackerConn, task, this.config.networkTimeout); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func (this *Client) doTracker(task task) error {
+// withTrackerConn lends fn one tracker connection for several commands. The
+// connection goes back to the pool by the error fn returns, and is dropped
+// if fn panics.
+func (this *Client) withTrackerConn(ctx context.Context, fn func(net.Conn) error) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	trackerConn, err := this.getTrackerConn()
 	if err != nil {
 		return err
 	}
-	defer trackerConn.Close()
-	
-	if err := task.SendReq(trackerConn); err != nil {
+	defer func() {
+		if r := recover(); r != nil {
+			releaseConn(trackerConn, fmt.Errorf("panic %v", r))
+			panic(r)
+		}
+		releaseConn(trackerConn, err)
+	}()
+	return fn(trackerConn)
+}
+
+func (this *Client) doStorage(ctx context.Context, task task, storageInfo *StorageInfo) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if err := task.RecvRes(trackerConn); err != nil {
+	storageConn, err := this.getStorageConn(storageInfo)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	err = runTask(ctx, storageConn, task, this.config.networkTimeout)
+	this.reportStorage(storageInfo.Addr, err, ctx.Err() != nil)
+	releaseConn(storageConn, err)
+	return err
 }
 
-func (this *Client) doStorage(task task, storageInfo *storageInfo) error {
-	storageConn, err := this.getStorageConn(storageInfo)
-	if err != nil {
-		return err
+//the breaker of the storage at addr, kept apart from its pool so that a
+//storage failing to be dialed has one too. nil unless enabled
+func (this *Client) storageBreaker(addr string) *breaker {
+	if this.config.breakerFailures <= 0 {
+		return nil
 	}
-	defer storageConn.Close()
-	
-	if err := task.SendReq(storageConn); err != nil {
-		return err
+	this.storagePoolLock.RLock()
+	storageBreaker, ok := this.storageBreakers[addr]
+	this.storagePoolLock.RUnlock()
+	if ok {
+		return storageBreaker
 	}
-	if err := task.RecvRes(storageConn); err != nil {
-		return err
+	this.storagePoolLock.Lock()
+	defer this.storagePoolLock.Unlock()
+	if storageBreaker, ok = this.storageBreakers[addr]; !ok {
+		storageBreaker = newBreaker(this.config.breakerFailures, this.config.breakerWindow, this.config.breakerCooldown)
+		this.storageBreakers[addr] = storageBreaker
 	}
+	return storageBreaker
+}
 
-	return nil
+//feeds the breaker of the storage at addr. A cancelled ctx or a local file
+//error says nothing about the storage, and a status error is a healthy answer
+func (this *Client) reportStorage(addr string, err error, cancelled bool) {
+	var pathErr *os.PathError
+	if cancelled || errors.Is(err, ErrFileExists) || errors.As(err, &pathErr) {
+		return
+	}
+	storageBreaker := this.storageBreaker(addr)
+	if err == nil || !isRetryable(err) {
+		storageBreaker.success()
+		return
+	}
+	if !storageBreaker.failure() {
+		return
+	}
+	this.config.getLogger().Warnf("fdfs: storage %s circuit open: %v", addr, err)
+	//the idle conns likely died with the storage, the trial after the
+	//cooldown should dial afresh
+	this.storagePoolLock.RLock()
+	storagePool := this.storagePools[addr]
+	this.storagePoolLock.RUnlock()
+	if storagePool != nil {
+		storagePool.closeIdleConns()
+	}
+}
+
+// runTask refreshes the conn deadline to timeout before each phase of the
+// task and pushes it into the past once ctx is done, so any blocked read or
+// write inside the task returns promptly.
+func runTask(ctx context.Context, conn net.Conn, task task, timeout time.Duration) error {
+	var lock sync.Mutex
+	cancelled := false
+	setDeadline := func() {
+		if timeout <= 0 {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if !cancelled {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+	}
+
+	finish := make(chan struct{})
+	exited := make(chan struct{})
+	if ctx.Done() != nil {
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				lock.Lock()
+				cancelled = true
+				conn.SetDeadline(time.Now())
+				lock.Unlock()
+			case <-finish:
+			}
+		}()
+	} else {
+		close(exited)
+	}
+
+	setDeadline()
+	err := task.SendReq(conn)
+	if err == nil {
+		setDeadline()
+		err = task.RecvRes(conn)
+	}
+	close(finish)
+	<-exited
+
+	if cancelled && err != nil {
+		return ctx.Err()
+	}
+	if cancelled || timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return err
+}
+
+// isRetryable reports transport failures. A status error is the server's
+// answer to the request itself and won't change on another attempt.
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	return !errors.As(err, &statusErr)
+}
+
+// releaseConn puts conn back to its pool, unless err left the stream in an
+// unknown state. Status errors come with a complete response and are safe.
+func releaseConn(conn net.Conn, err error) {
+	if err != nil && isRetryable(err) {
+		if pConn, ok := conn.(pConn); ok {
+			pConn.discard()
+			return
+		}
+	}
+	conn.Close()
+}
+
+//the storage to upload to, in groupName unless it is empty. Within
+//store_cache_ttl the last pick for the group is reused
+func (this *Client) queryStorageStore(ctx context.Context, groupName string) (*StorageInfo, error) {
+	if storageInfo, ok := this.storeCache.get(groupName); ok {
+		return storageInfo, nil
+	}
+	cmd := int8(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE)
+	if groupName != "" {
+		cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE
+	}
+	storageInfo, err := this.queryStorageInfoWithTracker(ctx, cmd, groupName, "")
+	if err != nil {
+		return nil, err
+	}
+	this.storeCache.put(groupName, storageInfo)
+	return storageInfo, nil
+}
+
+//the storage to change an existing file on, the one it was uploaded to
+func (this *Client) queryStorageUpdate(ctx context.Context, groupName string, remoteFilename string) (*StorageInfo, error) {
+	return this.queryStorageInfoWithTracker(ctx, TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE, groupName, remoteFilename)
 }
 
-func (this *Client) queryStorageInfoWithTracker(cmd int8, groupName string, remoteFilename string) (*storageInfo, error) {
+func (this *Client) queryStorageInfoWithTracker(ctx context.Context, cmd int8, groupName string, remoteFilename string) (*StorageInfo, error) {
+	if len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("group name %q longer than %d", groupName, FDFS_GROUP_NAME_MAX_LEN)
+	}
+	if len(remoteFilename) > FDFS_REMOTE_NAME_MAX_SIZE {
+		return nil, fmt.Errorf("remote filename of %d bytes longer than %d", len(remoteFilename), FDFS_REMOTE_NAME_MAX_SIZE)
+	}
 	task := &trackerTask{}
 	task.cmd = cmd
 	task.groupName = groupName
 	task.remoteFilename = remoteFilename
 
-	if err := this.doTracker(task); err != nil {
+	if err := this.doTracker(ctx, task); err != nil {
 		return nil, err
 	}
-	return &storageInfo{
-		addr:             fmt.Sprintf("%s:%d", task.ipAddr, task.port),
-		storagePathIndex: task.storePathIndex,
+	this.config.getLogger().Debugf("fdfs: tracker cmd %d chose storage %s:%d", cmd, task.ipAddr, task.port)
+	return &StorageInfo{
+		GroupName:      task.groupName,
+		Addr:           this.config.storageAddr(task.ipAddr, task.port),
+		StorePathIndex: task.storePathIndex,
 	}, nil
 }
 
+func (this *Client) queryAllStorageInfoWithTracker(ctx context.Context, groupName string, remoteFilename string) ([]StorageInfo, error) {
+	if len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return nil, fmt.Errorf("group name %q longer than %d", groupName, FDFS_GROUP_NAME_MAX_LEN)
+	}
+	if len(remoteFilename) > FDFS_REMOTE_NAME_MAX_SIZE {
+		return nil, fmt.Errorf("remote filename of %d bytes longer than %d", len(remoteFilename), FDFS_REMOTE_NAME_MAX_SIZE)
+	}
+	task := &trackerQueryAllTask{}
+	task.cmd = TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL
+	task.groupName = groupName
+	task.remoteFilename = remoteFilename
+
+	if err := this.doTracker(ctx, task); err != nil {
+		return nil, err
+	}
+	storageInfos := make([]StorageInfo, 0, len(task.ipAddrs))
+	for _, ipAddr := range task.ipAddrs {
+		storageInfos = append(storageInfos, StorageInfo{
+			GroupName: task.groupName,
+			Addr:      this.config.storageAddr(ipAddr, task.port),
+		})
+	}
+	return storageInfos, nil
+}
+
 func (this *Client) getTrackerConn() (net.Conn, error) {
-	var trackerConn net.Conn
 	var err error
-	var getOne bool
-	for _, trackerPool := range this.trackerPools {
+	trackerPools := this.trackerPools.get()
+	count := uint32(len(trackerPools))
+	start := atomic.AddUint32(&this.trackerIndex, 1)
+	for i := uint32(0); i < count; i++ {
+		trackerPool := trackerPools[(start+i)%count]
+		var trackerConn net.Conn
 		trackerConn, err = trackerPool.get()
 		if err == nil {
-			getOne = true
-			break
+			return trackerConn, nil
 		}
-	}
-	if getOne {
-		return trackerConn, nil
+		this.config.getLogger().Warnf("fdfs: tracker %s unavailable, failing over: %v", trackerPool.addr, err)
 	}
 	if err == nil {
-		return nil, fmt.Errorf("no connPool can be use")
+		return nil, ErrNoAvailableTracker
 	}
-	return nil, err
+	return nil, fmt.Errorf("%w: %v", ErrNoAvailableTracker, err)
 }
 
-func (this *Client) getStorageConn(storageInfo *storageInfo) (net.Conn, error) {
-	this.storagePoolLock.Lock()
-	storagePool, ok := this.storagePools[storageInfo.addr]
+//refused dials and pool timeouts count against the breaker of the storage
+func (this *Client) getStorageConn(storageInfo *StorageInfo) (net.Conn, error) {
+	if !this.storageBreaker(storageInfo.Addr).allow() {
+		return nil, fmt.Errorf("%s %w", storageInfo.Addr, ErrCircuitOpen)
+	}
+	this.storagePoolLock.RLock()
+	storagePool, ok := this.storagePools[storageInfo.Addr]
+	this.storagePoolLock.RUnlock()
 	if ok {
-		this.storagePoolLock.Unlock()
-		return storagePool.get()
+		return this.borrowStorageConn(storagePool)
 	}
-	storagePool, err := newConnPool(storageInfo.addr, this.config.maxConns)
+	//dial without the lock, a new storage must not stall the known ones
+	newPool, err := newConnPool(storageInfo.Addr, this.config)
 	if err != nil {
-		this.storagePoolLock.Unlock()
+		this.reportStorage(storageInfo.Addr, err, false)
 		return nil, err
 	}
-	this.storagePools[storageInfo.addr] = storagePool
+	this.storagePoolLock.Lock()
+	storagePool, ok = this.storagePools[storageInfo.Addr]
+	closed := *this.closed
+	if !ok && !closed {
+		storagePool = newPool
+		this.storagePools[storageInfo.Addr] = storagePool
+	}
 	this.storagePoolLock.Unlock()
-	return storagePool.get()
+	if closed {
+		newPool.Destroy()
+		return nil, fmt.Errorf("client closed")
+	}
+	if ok {
+		//lost the race, another goroutine stored its pool first
+		newPool.Destroy()
+	}
+	return this.borrowStorageConn(storagePool)
+}
+
+func (this *Client) borrowStorageConn(storagePool *connPool) (net.Conn, error) {
+	conn, err := storagePool.get()
+	if err != nil {
+		this.reportStorage(storagePool.addr, err, false)
+	}
+	return conn, err
 }
@@ -2,77 +2,184 @@ package fdfs_client
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
 const (
+	TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS                = 91
+	TRACKER_PROTO_CMD_SERVER_LIST_STORAGE                   = 92
+	TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE                 = 93
 	TRACKER_PROTO_CMD_RESP                                  = 100
 	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE = 101
 	TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE               = 102
+	TRACKER_PROTO_CMD_SERVICE_QUERY_UPDATE                  = 103
+	TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE    = 104
+	TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ALL               = 105
 
-	STORAGE_PROTO_CMD_UPLOAD_FILE   = 11
-	STORAGE_PROTO_CMD_DELETE_FILE   = 12
-	STORAGE_PROTO_CMD_DOWNLOAD_FILE = 14
-	FDFS_PROTO_CMD_ACTIVE_TEST      = 111
+	STORAGE_PROTO_CMD_UPLOAD_FILE                  = 11
+	STORAGE_PROTO_CMD_DELETE_FILE                  = 12
+	STORAGE_PROTO_CMD_SET_METADATA                 = 13
+	STORAGE_PROTO_CMD_DOWNLOAD_FILE                = 14
+	STORAGE_PROTO_CMD_GET_METADATA                 = 15
+	STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE            = 21
+	STORAGE_PROTO_CMD_QUERY_FILE_INFO              = 22
+	STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE         = 23
+	STORAGE_PROTO_CMD_APPEND_FILE                  = 24
+	STORAGE_PROTO_CMD_MODIFY_FILE                  = 34
+	STORAGE_PROTO_CMD_TRUNCATE_FILE                = 36
+	STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME = 38
+	FDFS_PROTO_CMD_ACTIVE_TEST                     = 111
 )
 
 const (
-	FDFS_GROUP_NAME_MAX_LEN = 16
+	FDFS_GROUP_NAME_MAX_LEN    = 16
+	FDFS_FILE_EXT_NAME_MAX_LEN = 6
+	FDFS_FILE_PREFIX_MAX_LEN   = 16
+	IP_ADDRESS_SIZE            = 16
+	FDFS_STORAGE_ID_MAX_SIZE   = 16
+	FDFS_DOMAIN_NAME_MAX_SIZE  = 128
+	FDFS_REMOTE_NAME_MAX_SIZE  = 128
+	FDFS_VERSION_SIZE          = 6
+	TRACKER_GROUP_STAT_SIZE    = FDFS_GROUP_NAME_MAX_LEN + 1 + 11*8
+	//status, ids and names, 10 fields, 3 connection counts, 42 counters, trunk flag
+	TRACKER_STORAGE_STAT_SIZE = 1 + 2*FDFS_STORAGE_ID_MAX_SIZE + IP_ADDRESS_SIZE + FDFS_DOMAIN_NAME_MAX_SIZE + FDFS_VERSION_SIZE + 10*8 + 3*4 + 42*8 + 1
+
+	FDFS_LOGIC_FILE_PATH_LEN          = 10
+	FDFS_FILENAME_BASE64_LENGTH       = 27
+	FDFS_NORMAL_LOGIC_FILENAME_LENGTH = FDFS_LOGIC_FILE_PATH_LEN + FDFS_FILENAME_BASE64_LENGTH + FDFS_FILE_EXT_NAME_MAX_LEN + 1
+	FDFS_TRUNK_FILE_INFO_LEN          = 16
+	FDFS_TRUNK_LOGIC_FILENAME_LENGTH  = FDFS_NORMAL_LOGIC_FILENAME_LENGTH + FDFS_TRUNK_FILE_INFO_LEN
+	FDFS_APPENDER_FILE_SIZE           = 256 * 1024 * 1024 * 1024 * 1024 * 1024
+	FDFS_TRUNK_FILE_MARK_SIZE         = 512 * 1024 * 1024 * 1024 * 1024 * 1024
+
+	FDFS_RECORD_SEPERATOR = '\x01'
+	FDFS_FIELD_SEPERATOR  = '\x02'
+
+	STORAGE_SET_METADATA_FLAG_OVERWRITE = 'O'
+	STORAGE_SET_METADATA_FLAG_MERGE     = 'M'
 )
 
-type storageInfo struct {
-	addr             string
-	storagePathIndex int8
+var fdfsBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_").WithPadding(base64.NoPadding)
+
+// StorageInfo is a storage server as answered by a tracker query.
+// StorePathIndex is only chosen by the tracker for store queries.
+type StorageInfo struct {
+	GroupName      string
+	Addr           string
+	StorePathIndex int8
 }
 
 type fileInfo struct {
 	fileSize    int64
 	buffer      []byte
 	file        *os.File
+	reader      io.Reader
+	readerStart int64
 	fileExtName string
+	progress    func(sent, total int64)
 }
 
+//fileExtName is that of fileName unless given
 func newFileInfo(fileName string, buffer []byte, fileExtName string) (*fileInfo, error) {
 	if fileName != "" {
+		if fileExtName == "" {
+			fileExtName = fileExtNameOf(fileName)
+		}
 		file, err := os.Open(fileName)
 		if err != nil {
 			return nil, err
 		}
 		stat, err := file.Stat()
 		if err != nil {
+			file.Close()
 			return nil, err
 		}
-		if int(stat.Size()) == 0 {
-			return nil, fmt.Errorf("file %q size is zero", fileName)
-		}
-		var fileExtName string
-		index := strings.LastIndexByte(fileName, '.')
-		if index != -1 {
-			fileExtName = fileName[index+1:]
-			if len(fileExtName) > 6 {
-				fileExtName = fileExtName[:6]
-			}
-		}
 		return &fileInfo{
 			fileSize:    stat.Size(),
 			file:        file,
-			fileExtName: fileExtName,
+			fileExtName: clampFileExtName(fileExtName),
 		}, nil
 	}
-	if len(fileExtName) > 6 {
-		fileExtName = fileExtName[:6]
-	}
 	return &fileInfo{
 		fileSize:    int64(len(buffer)),
 		buffer:      buffer,
-		fileExtName: fileExtName,
+		fileExtName: clampFileExtName(fileExtName),
 	}, nil
 }
 
+//the whole of an already open file, which stays owned by the caller
+func newFileInfoFromFile(file *os.File, fileExtName string) (*fileInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &fileInfo{
+		fileSize:    stat.Size(),
+		file:        file,
+		fileExtName: clampFileExtName(fileExtName),
+	}, nil
+}
+
+func newFileInfoFromReader(reader io.Reader, size int64, fileExtName string) (*fileInfo, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid reader size %d", size)
+	}
+	fileInfo := &fileInfo{
+		fileSize:    size,
+		reader:      reader,
+		readerStart: -1,
+		fileExtName: clampFileExtName(fileExtName),
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			fileInfo.readerStart = offset
+		}
+	}
+	return fileInfo, nil
+}
+
+//filepath.Ext of the basename without the dot, a dotfile like .gitignore has
+//no ext
+func fileExtNameOf(fileName string) string {
+	baseName := strings.TrimLeft(filepath.Base(fileName), ".")
+	return strings.TrimPrefix(filepath.Ext(baseName), ".")
+}
+
+func clampFileExtName(fileExtName string) string {
+	if len(fileExtName) > FDFS_FILE_EXT_NAME_MAX_LEN {
+		return fileExtName[:FDFS_FILE_EXT_NAME_MAX_LEN]
+	}
+	return fileExtName
+}
+
+// rewind prepares the content to be sent again after a failed attempt.
+func (this *fileInfo) rewind() error {
+	if this.file != nil {
+		_, err := this.file.Seek(0, io.SeekStart)
+		return err
+	}
+	if this.reader != nil {
+		seeker, ok := this.reader.(io.Seeker)
+		if !ok || this.readerStart < 0 {
+			return fmt.Errorf("reader can't be rewound")
+		}
+		_, err := seeker.Seek(this.readerStart, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
 func (this *fileInfo) Close() {
 	if this == nil {
 		return
@@ -94,53 +201,165 @@ type header struct {
 	status int8
 }
 
-func (this *header) SendHeader(conn net.Conn) error {
-	buffer := new(bytes.Buffer)
-	if err := binary.Write(buffer, binary.BigEndian, this.pkgLen); err != nil {
-		return err
-	}
-	buffer.WriteByte(byte(this.cmd))
-	buffer.WriteByte(byte(this.status))
+const headerSize = 10
 
-	if _, err := conn.Write(buffer.Bytes()); err != nil {
-		return err
+//the fixed head of every request and response: pkgLen as a big-endian
+//int64, then cmd and status
+func writeHeader(w io.Writer, pkgLen int64, cmd int8, status int8) error {
+	var buf [headerSize]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(pkgLen))
+	buf[8] = byte(cmd)
+	buf[9] = byte(status)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readHeader(r io.Reader) (pkgLen int64, cmd int8, status int8, err error) {
+	var buf [headerSize]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return 0, 0, 0, err
 	}
-	return nil
+	pkgLen = int64(binary.BigEndian.Uint64(buf[:8]))
+	if pkgLen < 0 {
+		//the sign bit set is a corrupt stream, not a huge body
+		return 0, 0, 0, fmt.Errorf("header pkgLen %d < 0", pkgLen)
+	}
+	return pkgLen, int8(buf[8]), int8(buf[9]), nil
+}
+
+func (this *header) SendHeader(conn net.Conn) error {
+	return writeHeader(conn, this.pkgLen, this.cmd, this.status)
 }
 
 func (this *header) RecvHeader(conn net.Conn) error {
-	buf := make([]byte, 10)
-	if _, err := conn.Read(buf); err != nil {
+	pkgLen, cmd, status, err := readHeader(conn)
+	if err != nil {
 		return err
 	}
+	this.pkgLen = pkgLen
+	if status != 0 {
+		return &StatusError{Cmd: this.cmd, Status: status}
+	}
+	this.cmd = cmd
+	this.status = status
+	return nil
+}
 
-	buffer := bytes.NewBuffer(buf)
+type FileDetail struct {
+	FileSize        int64
+	CreateTimestamp int64
+	Crc32           uint32
+	SourceIpAddr    string
+}
 
-	if err := binary.Read(buffer, binary.BigEndian, &this.pkgLen); err != nil {
-		return err
+// decodeFileDetail parses the info the storage encodes in a remote filename.
+// ok is false for appender and slave files, whose names don't describe the
+// current content, so the storage has to be asked instead.
+func decodeFileDetail(remoteFilename string) (fileDetail *FileDetail, ok bool, err error) {
+	if len(remoteFilename) < FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH {
+		return nil, false, fmt.Errorf("remote filename %q too short", remoteFilename)
 	}
-	cmd, err := buffer.ReadByte()
+	buf, err := fdfsBase64.DecodeString(remoteFilename[FDFS_LOGIC_FILE_PATH_LEN : FDFS_LOGIC_FILE_PATH_LEN+FDFS_FILENAME_BASE64_LENGTH])
 	if err != nil {
-		return err
+		return nil, false, fmt.Errorf("remote filename %q decode %v", remoteFilename, err)
 	}
-	status, err := buffer.ReadByte()
-	if err != nil {
-		return err
+	fileSize := int64(binary.BigEndian.Uint64(buf[8:16]))
+	trunk := fileSize&FDFS_TRUNK_FILE_MARK_SIZE != 0
+	//trunk file names carry the trunk info after the base64 part
+	slave := len(remoteFilename) > FDFS_TRUNK_LOGIC_FILENAME_LENGTH ||
+		len(remoteFilename) > FDFS_NORMAL_LOGIC_FILENAME_LENGTH && !trunk
+	if fileSize&FDFS_APPENDER_FILE_SIZE != 0 || slave {
+		return nil, false, nil
 	}
-	if status != 0 {
-		return fmt.Errorf("recv resp status %d != 0", status)
+	if fileSize < 0 || trunk {
+		//high 32 bits are random or the trunk mark when the size fits in 32 bits
+		fileSize &= 0xFFFFFFFF
 	}
-	this.cmd = int8(cmd)
-	this.status = int8(status)
-	return nil
+	return &FileDetail{
+		FileSize:        fileSize,
+		CreateTimestamp: int64(binary.BigEndian.Uint32(buf[4:8])),
+		Crc32:           binary.BigEndian.Uint32(buf[16:20]),
+		SourceIpAddr:    net.IPv4(buf[0], buf[1], buf[2], buf[3]).String(),
+	}, true, nil
 }
 
+func packMetadata(meta map[string]string) []byte {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buffer := new(bytes.Buffer)
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(FDFS_RECORD_SEPERATOR)
+		}
+		buffer.WriteString(key)
+		buffer.WriteByte(FDFS_FIELD_SEPERATOR)
+		buffer.WriteString(meta[key])
+	}
+	return buffer.Bytes()
+}
+
+func unpackMetadata(buffer []byte) map[string]string {
+	meta := make(map[string]string)
+	for _, record := range bytes.Split(buffer, []byte{FDFS_RECORD_SEPERATOR}) {
+		if len(record) == 0 {
+			continue
+		}
+		fields := bytes.SplitN(record, []byte{FDFS_FIELD_SEPERATOR}, 2)
+		if len(fields) == 2 {
+			meta[string(fields[0])] = string(fields[1])
+		} else {
+			meta[string(fields[0])] = ""
+		}
+	}
+	return meta
+}
+
+//fileIds are "group/remote", the older "group:remote" is still accepted.
+//group names contain neither, so the first one splits
 func splitFileId(fileId string) (string, string, error) {
-	str := strings.SplitN(fileId, ":", 2)
-	if len(str) < 2 {
-		return "", "", fmt.Errorf("invalid fildId")
+	index := strings.IndexAny(fileId, "/:")
+	if index == -1 {
+		return "", "", fmt.Errorf("invalid fileId %q, no group separator", fileId)
+	}
+	groupName, remoteFilename := fileId[:index], fileId[index+1:]
+	if err := checkFileId(groupName, remoteFilename); err != nil {
+		return "", "", fmt.Errorf("invalid fileId %q, %v", fileId, err)
+	}
+	return groupName, remoteFilename, nil
+}
+
+func checkFileId(groupName string, remoteFilename string) error {
+	if groupName == "" {
+		return fmt.Errorf("empty group name")
+	}
+	if len(groupName) > FDFS_GROUP_NAME_MAX_LEN {
+		return fmt.Errorf("group name %q longer than %d", groupName, FDFS_GROUP_NAME_MAX_LEN)
+	}
+	if strings.ContainsAny(groupName, "/:") {
+		return fmt.Errorf("group name %q contains a separator", groupName)
+	}
+	if remoteFilename == "" {
+		return fmt.Errorf("empty remote filename")
 	}
-	return str[0], str[1], nil
+	if remoteFilename[0] == '/' {
+		return fmt.Errorf("remote filename %q starts with a slash", remoteFilename)
+	}
+	//bounds the pkgLen of every request carrying it
+	if len(remoteFilename) > FDFS_REMOTE_NAME_MAX_SIZE {
+		return fmt.Errorf("remote filename of %d bytes longer than %d", len(remoteFilename), FDFS_REMOTE_NAME_MAX_SIZE)
+	}
+	return nil
+}
+
+//group names are sent NUL padded to 16 bytes, longer ones are cut off
+func packGroupName(groupName string) [FDFS_GROUP_NAME_MAX_LEN]byte {
+	var buffer [FDFS_GROUP_NAME_MAX_LEN]byte
+	copy(buffer[:], groupName)
+	return buffer
 }
 
 // func splitFileId(fileId string) (string, string, error) {
@@ -0,0 +1,196 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	for _, want := range []header{
+		{pkgLen: 0, cmd: FDFS_PROTO_CMD_ACTIVE_TEST},
+		{pkgLen: 40, cmd: TRACKER_PROTO_CMD_RESP},
+		{pkgLen: int64(3) << 30, cmd: STORAGE_PROTO_CMD_UPLOAD_FILE},
+		{pkgLen: 0, cmd: TRACKER_PROTO_CMD_RESP, status: statusENOENT},
+	} {
+		buf := new(bytes.Buffer)
+		if err := writeHeader(buf, want.pkgLen, want.cmd, want.status); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != headerSize {
+			t.Fatalf("wrote %d bytes, want %d", buf.Len(), headerSize)
+		}
+		pkgLen, cmd, status, err := readHeader(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (header{pkgLen: pkgLen, cmd: cmd, status: status}); got != want {
+			t.Fatalf("read %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestReadHeaderShort(t *testing.T) {
+	if _, _, _, err := readHeader(bytes.NewReader(make([]byte, headerSize-1))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("readHeader = %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestRecvHeaderStatus(t *testing.T) {
+	buf := new(bytes.Buffer)
+	writeHeader(buf, 0, TRACKER_PROTO_CMD_RESP, statusENOENT)
+	header := &header{cmd: STORAGE_PROTO_CMD_QUERY_FILE_INFO}
+	err := header.RecvHeader(&replayConn{response: bytes.NewReader(buf.Bytes())})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Cmd != STORAGE_PROTO_CMD_QUERY_FILE_INFO || statusErr.Status != statusENOENT {
+		t.Fatalf("RecvHeader = %v", err)
+	}
+}
+
+func TestWriteHeaderBytes(t *testing.T) {
+	for _, tc := range []struct {
+		pkgLen int64
+		want   []byte
+	}{
+		{0, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{255, []byte{0, 0, 0, 0, 0, 0, 0, 0xff}},
+		{65536, []byte{0, 0, 0, 0, 0, 1, 0, 0}},
+		{1 << 40, []byte{0, 0, 1, 0, 0, 0, 0, 0}},
+	} {
+		buf := new(bytes.Buffer)
+		if err := writeHeader(buf, tc.pkgLen, STORAGE_PROTO_CMD_UPLOAD_FILE, 0); err != nil {
+			t.Fatal(err)
+		}
+		want := append(tc.want, STORAGE_PROTO_CMD_UPLOAD_FILE, 0)
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("pkgLen %d encoded % x, want % x", tc.pkgLen, buf.Bytes(), want)
+		}
+		if pkgLen, _, _, _ := readHeader(buf); pkgLen != tc.pkgLen {
+			t.Fatalf("decoded %d, want %d", pkgLen, tc.pkgLen)
+		}
+	}
+}
+
+func TestReadHeaderNegative(t *testing.T) {
+	buf := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, TRACKER_PROTO_CMD_RESP, 0}
+	if _, _, _, err := readHeader(bytes.NewReader(buf)); err == nil {
+		t.Fatal("readHeader accepted a negative pkgLen")
+	}
+}
+
+func TestFileExtNameOf(t *testing.T) {
+	for _, tc := range []struct {
+		fileName string
+		want     string
+	}{
+		{"/data/archive.tar.gz", "gz"},
+		{"photo.JPG", "JPG"},
+		{"/data/.gitignore", ""},
+		{"/data/.config.yml", "yml"},
+		{"noext", ""},
+		{"/data.d/noext", ""},
+		{"trailing.", ""},
+		{"", ""},
+	} {
+		if got := fileExtNameOf(tc.fileName); got != tc.want {
+			t.Errorf("fileExtNameOf(%q) = %q, want %q", tc.fileName, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeFileDetail(t *testing.T) {
+	//192.168.1.10, created 1600000000, 1234 bytes, crc32 0xDEADBEEF
+	normal := &FileDetail{FileSize: 1234, CreateTimestamp: 1600000000, Crc32: 0xDEADBEEF, SourceIpAddr: "192.168.1.10"}
+	for _, tc := range []struct {
+		remoteFilename string
+		want           *FileDetail
+		ok             bool
+		err            bool
+	}{
+		{"M00/00/00/wKgBCl9eEAAAAAAAAAAE0t6tvu8.txt", normal, true, false},
+		{"M00/00/00/wKgBCl9eEAAAAAAAAAAE0t6tvu8", normal, true, false},
+		//random high 32 bits over a 32 bit size
+		{"M00/00/00/wKgBCl9eEACAEjRWAAAE0t6tvu8.txt", normal, true, false},
+		//appender size flag
+		{"M00/00/00/wKgBCl9eEAAEAAAAAAAE0t6tvu8.txt", nil, false, false},
+		//trunk mark, with and without the trunk info
+		{"M00/00/00/wKgBCl9eEAAIAAAAAAAE0t6tvu8.txt", normal, true, false},
+		{"M00/00/00/wKgBCl9eEAAIAAAAAAAE0t6tvu8AAAAAAAAAAAAAAAAA.txt", normal, true, false},
+		{"M00/00/00/wKgBCl9eEAAIAAAAAAAE0t6tvu8AAAAAAAAAAAAAAAAA_150x150.txt", nil, false, false},
+		//slave file
+		{"M00/00/00/wKgBCl9eEAAAAAAAAAAE0t6tvu8_150x150.txt", nil, false, false},
+		{"M00/00/00/wKgBCl9eEAAA.txt", nil, false, true},
+		{"M00/00/00/wKgBCl9eEAAAAAAAAAAE0t6tvu*.txt", nil, false, true},
+	} {
+		got, ok, err := decodeFileDetail(tc.remoteFilename)
+		if (err != nil) != tc.err || ok != tc.ok {
+			t.Errorf("decodeFileDetail(%q) ok %v, err %v", tc.remoteFilename, ok, err)
+			continue
+		}
+		if (got == nil) != (tc.want == nil) || got != nil && *got != *tc.want {
+			t.Errorf("decodeFileDetail(%q) = %+v, want %+v", tc.remoteFilename, got, tc.want)
+		}
+	}
+}
+
+func TestPackMetadata(t *testing.T) {
+	for _, test := range []struct {
+		meta map[string]string
+		want string
+	}{
+		{map[string]string{}, ""},
+		{nil, ""},
+		{map[string]string{"width": "1024"}, "width\x021024"},
+		//sorted by key, records split by 0x01 and key from value by 0x02 as in fastdfs
+		{map[string]string{"width": "1024", "height": "768", "empty": ""}, "empty\x02\x01height\x02768\x01width\x021024"},
+	} {
+		if got := string(packMetadata(test.meta)); got != test.want {
+			t.Errorf("packMetadata(%v) = %q, want %q", test.meta, got, test.want)
+		}
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	for _, meta := range []map[string]string{
+		{},
+		{"author": "tedcy", "empty": ""},
+		//only the first field separator splits, the rest stays in the value
+		{"ratio": "16\x029"},
+	} {
+		got := unpackMetadata(packMetadata(meta))
+		if len(got) != len(meta) {
+			t.Fatalf("round trip of %q = %q", meta, got)
+		}
+		for key, value := range meta {
+			if got[key] != value {
+				t.Fatalf("round trip of %q = %q", meta, got)
+			}
+		}
+	}
+}
+
+func TestUnpackMetadata(t *testing.T) {
+	for _, test := range []struct {
+		buffer string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"width\x021024\x01height\x02768", map[string]string{"width": "1024", "height": "768"}},
+		//a trailing or doubled record separator adds no entry
+		{"width\x021024\x01", map[string]string{"width": "1024"}},
+		{"width\x021024\x01\x01height\x02768", map[string]string{"width": "1024", "height": "768"}},
+		//a key without field separator has an empty value
+		{"flag", map[string]string{"flag": ""}},
+	} {
+		got := unpackMetadata([]byte(test.buffer))
+		if got == nil || len(got) != len(test.want) {
+			t.Fatalf("unpackMetadata(%q) = %q, want %q", test.buffer, got, test.want)
+		}
+		for key, value := range test.want {
+			if got[key] != value {
+				t.Fatalf("unpackMetadata(%q) = %q, want %q", test.buffer, got, test.want)
+			}
+		}
+	}
+}
@@ -2,48 +2,231 @@ package fdfs_client
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
 	"os"
 	"strconv"
 	"strings"
-	"runtime"
+	"time"
+)
+
+const (
+	DEFAULT_CONNECT_TIMEOUT   = time.Second * 10
+	DEFAULT_MAX_CONNS         = 100
+	DEFAULT_DOWNLOAD_DIR_PERM = 0755
 )
 
 type config struct {
-	trackerAddr []string
-	maxConns    int
+	trackerAddr     []string
+	maxConns        int
+	connectTimeout  time.Duration
+	networkTimeout  time.Duration
+	uploadTimeout   time.Duration
+	downloadTimeout time.Duration
+	maxIdleTime     time.Duration
+	poolWaitTimeout time.Duration
+	storeCacheTTL   time.Duration
+	breakerFailures int
+	breakerWindow   time.Duration
+	breakerCooldown time.Duration
+	testOnBorrow    bool
+	maxRetries      int
+	retryInterval   time.Duration
+	retryBackoff    bool
+	defaultExtName  string
+	allowEmptyFile  bool
+	maxFileSize     int64
+	useStorageId    bool
+	storageIds      map[string]string
+	downloadDirPerm os.FileMode
+	downloadInPlace bool
+	overwritePolicy OverwritePolicy
+	bufferSize      int
+	tlsConfig       *tls.Config
+	dialContext     func(ctx context.Context, network, addr string) (net.Conn, error)
+	connFactory     func(addr string) (net.Conn, error)
+	logger          Logger
+	metrics         Metrics
+	buffers         *bufferPool
+}
+
+//what a config without the key, file or options, gets
+func defaultConfig() *config {
+	return &config{
+		maxConns: DEFAULT_MAX_CONNS,
+	}
 }
 
 func newConfig(configName string) (*config, error) {
-	config := &config{}
 	f, err := os.Open(configName)
 	if err != nil {
 		return nil, err
 	}
-	splitFlag := "\n"
-	if runtime.GOOS == "windows" {
-		splitFlag = "\r\n"
-	}
-	reader := bufio.NewReader(f)
+	defer f.Close()
+	return newConfigFromReader(f)
+}
+
+//same key=value format as the config file, for embedded or generated configs
+func newConfigFromReader(r io.Reader) (*config, error) {
+	config := defaultConfig()
+	var problems []string
+	reader := bufio.NewReader(r)
 	for {
-		line, err := reader.ReadString('\n')
-		line = strings.TrimSuffix(line, splitFlag)
-		str := strings.SplitN(line, "=", 2)
-		switch str[0] {
-		case "tracker_server":
-			config.trackerAddr = append(config.trackerAddr, str[1])
-		case "maxConns":
-			config.maxConns, err = strconv.Atoi(str[1])
-			if err != nil {
-				return nil, err
-			}
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return nil, readErr
+		}
+		//comments run to the end of line, as in fastdfs client.conf
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
 		}
-		if err != nil {
-			if err == io.EOF {
-				return config, nil
+		//blank lines and anything else without a value match no key
+		if str := strings.SplitN(line, "=", 2); len(str) == 2 {
+			key, value := strings.TrimSpace(str[0]), strings.TrimSpace(str[1])
+			if err := config.set(key, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s %v", key, err))
 			}
-			return nil, err
 		}
+		if readErr == io.EOF {
+			break
+		}
+	}
+	problems = append(problems, config.problems()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
 	}
 	return config, nil
 }
+
+//keys match case-insensitively, unknown ones are ignored
+func (this *config) set(key string, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "tracker_server":
+		this.trackerAddr = append(this.trackerAddr, strings.TrimSpace(value))
+	case "maxconns", "max_conns":
+		this.maxConns, err = strconv.Atoi(value)
+	case "connect_timeout":
+		this.connectTimeout, err = parseTimeout(value)
+	case "network_timeout":
+		this.networkTimeout, err = parseTimeout(value)
+	case "upload_timeout":
+		this.uploadTimeout, err = parseTimeout(value)
+	case "download_timeout":
+		this.downloadTimeout, err = parseTimeout(value)
+	case "max_idle_time":
+		this.maxIdleTime, err = parseTimeout(value)
+	case "pool_wait_timeout":
+		this.poolWaitTimeout, err = parseTimeout(value)
+	case "store_cache_ttl":
+		this.storeCacheTTL, err = parseTimeout(value)
+	case "breaker_failures":
+		this.breakerFailures, err = strconv.Atoi(value)
+	case "breaker_window":
+		this.breakerWindow, err = parseTimeout(value)
+	case "breaker_cooldown":
+		this.breakerCooldown, err = parseTimeout(value)
+	case "test_on_borrow":
+		this.testOnBorrow, err = strconv.ParseBool(value)
+	case "max_retries":
+		this.maxRetries, err = strconv.Atoi(value)
+	case "retry_interval":
+		this.retryInterval, err = parseTimeout(value)
+	case "retry_backoff":
+		this.retryBackoff, err = strconv.ParseBool(value)
+	case "default_ext_name":
+		this.defaultExtName = value
+	case "allow_empty_file":
+		this.allowEmptyFile, err = strconv.ParseBool(value)
+	case "download_dir_perm":
+		var perm uint64
+		perm, err = strconv.ParseUint(value, 8, 32)
+		this.downloadDirPerm = os.FileMode(perm)
+	case "download_in_place":
+		this.downloadInPlace, err = strconv.ParseBool(value)
+	case "download_overwrite":
+		this.overwritePolicy, err = parseOverwritePolicy(value)
+	case "max_file_size":
+		this.maxFileSize, err = strconv.ParseInt(value, 10, 64)
+	case "use_storage_id":
+		this.useStorageId, err = strconv.ParseBool(value)
+	case "storage_ids_filename":
+		this.storageIds, err = loadStorageIds(value)
+	case "buffer_size":
+		this.bufferSize, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+//fail at load rather than with a confusing dial error later
+func (this *config) validate() error {
+	if problems := this.problems(); len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (this *config) problems() []string {
+	var problems []string
+	if len(this.trackerAddr) == 0 {
+		problems = append(problems, "no tracker_server")
+	}
+	for _, addr := range this.trackerAddr {
+		//host:port, with IPv6 hosts in brackets like [::1]:22122
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			problems = append(problems, fmt.Sprintf("tracker_server %v", err))
+		}
+	}
+	if this.useStorageId && this.storageIds == nil {
+		problems = append(problems, "use_storage_id without storage_ids_filename")
+	}
+	if this.maxConns < MAXCONNS_LEAST {
+		problems = append(problems, fmt.Sprintf("maxConns %d < %d", this.maxConns, MAXCONNS_LEAST))
+	}
+	return problems
+}
+
+//the perm for the missing parent dirs of a download
+func (this *config) getDownloadDirPerm() os.FileMode {
+	if this.downloadDirPerm == 0 {
+		return DEFAULT_DOWNLOAD_DIR_PERM
+	}
+	return this.downloadDirPerm
+}
+
+//seconds as in fastdfs client.conf, or a duration like "500ms"
+func parseTimeout(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// OverwritePolicy is what a download to file does when the local file
+// already exists.
+type OverwritePolicy int
+
+const (
+	// OverwriteFile replaces the file, the default.
+	OverwriteFile OverwritePolicy = iota
+	// FailIfExists fails with ErrFileExists.
+	FailIfExists
+	// SkipIfExists keeps the file and reports success without downloading.
+	SkipIfExists
+)
+
+//overwrite, fail or skip as download_overwrite in the config file
+func parseOverwritePolicy(value string) (OverwritePolicy, error) {
+	switch value {
+	case "overwrite":
+		return OverwriteFile, nil
+	case "fail":
+		return FailIfExists, nil
+	case "skip":
+		return SkipIfExists, nil
+	}
+	return OverwriteFile, fmt.Errorf("unknown policy %q", value)
+}
@@ -3,6 +3,8 @@ package fdfs_client
 import (
 	"testing"
 	"fmt"
+	"strings"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -14,3 +16,81 @@ func TestConfig(t *testing.T) {
 	fmt.Println(config.trackerAddr)
 	fmt.Println(config.maxConns)
 }
+
+func TestConfigFromReader(t *testing.T) {
+	conf := "tracker_server=10.0.0.1:22122\r\n" +
+		"\n" +
+		"# comment\n" +
+		"tracker_server=10.0.0.2:22122\n" +
+		"maxConns=20\n" +
+		"network_timeout=500ms"
+	config, err := newConfigFromReader(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.trackerAddr) != 2 || config.trackerAddr[0] != "10.0.0.1:22122" || config.trackerAddr[1] != "10.0.0.2:22122" {
+		t.Fatalf("trackerAddr = %v", config.trackerAddr)
+	}
+	if config.maxConns != 20 {
+		t.Fatalf("maxConns = %d", config.maxConns)
+	}
+	if config.networkTimeout != 500*time.Millisecond {
+		t.Fatalf("networkTimeout = %v", config.networkTimeout)
+	}
+}
+
+func TestConfigIPv6Tracker(t *testing.T) {
+	config, err := newConfigFromReader(strings.NewReader("tracker_server=[::1]:22122\nmaxConns=10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.trackerAddr) != 1 || config.trackerAddr[0] != "[::1]:22122" {
+		t.Fatalf("trackerAddr = %v", config.trackerAddr)
+	}
+	if _, err := newConfigFromReader(strings.NewReader("tracker_server=::1:22122\n")); err == nil {
+		t.Fatal("accepted an IPv6 tracker without brackets")
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config, err := newConfigFromReader(strings.NewReader("tracker_server=127.0.0.1:22122\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.maxConns != DEFAULT_MAX_CONNS {
+		t.Fatalf("maxConns = %d", config.maxConns)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	_, err := newConfigFromReader(strings.NewReader("maxConns=x\nconnect_timeout=1\n"))
+	if err == nil {
+		t.Fatal("accepted a config without tracker_server")
+	}
+	for _, problem := range []string{"maxConns", "no tracker_server"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("%q doesn't report %s", err, problem)
+		}
+	}
+}
+
+func TestConfigLenient(t *testing.T) {
+	conf := "Tracker_Server = 10.0.0.1:22122  # primary\n" +
+		"  MAX_CONNS=20\t\n" +
+		"connect_timeout=5 # seconds\n" +
+		"http.tracker_server_port=80\n" +
+		"unknown_key=whatever\n"
+	config, err := newConfigFromReader(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.trackerAddr) != 1 || config.trackerAddr[0] != "10.0.0.1:22122" {
+		t.Fatalf("trackerAddr = %q", config.trackerAddr)
+	}
+	if config.maxConns != 20 {
+		t.Fatalf("maxConns = %d", config.maxConns)
+	}
+	if config.connectTimeout != 5*time.Second {
+		t.Fatalf("connectTimeout = %v", config.connectTimeout)
+	}
+}
@@ -2,6 +2,8 @@ package fdfs_client
 
 import (
 	"container/list"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
@@ -10,39 +12,115 @@ import (
 
 const (
 	MAXCONNS_LEAST = 5
+	//a max_idle_time of a few ns would halve to a zero ticker period
+	minReapInterval = time.Millisecond
 )
 
 type pConn struct {
 	net.Conn
-	pool *connPool
+	pool     *connPool
+	lastUsed time.Time
 }
 
 func (c pConn) Close() error {
 	return c.pool.put(c)
 }
 
+func (c pConn) discard() error {
+	return c.pool.remove(c)
+}
+
+type PoolStats struct {
+	Idle         int
+	Open         int
+	MaxConns     int
+	TotalCreated int64
+	//storages only, see WithCircuitBreaker
+	CircuitOpen bool
+}
+
 type connPool struct {
-	conns    *list.List
-	addr     string
-	maxConns int
-	count    int
-	lock     *sync.RWMutex
-	finish   chan bool
+	conns          *list.List
+	waiters        *list.List
+	addr           string
+	maxConns       int
+	connectTimeout time.Duration
+	tlsConfig      *tls.Config
+	dialContext    func(ctx context.Context, network, addr string) (net.Conn, error)
+	factory        func() (net.Conn, error)
+	maxIdleTime    time.Duration
+	waitTimeout    time.Duration
+	testOnBorrow   bool
+	count          int
+	created        int64
+	lock           *sync.RWMutex
+	finish         chan bool
+	stop           sync.Once
+	closed         bool
+	logger         Logger
+	metrics        Metrics
+	buffers        *bufferPool
 }
 
-func newConnPool(addr string, maxConns int) (*connPool, error) {
-	if maxConns < MAXCONNS_LEAST {
+func newConnPool(addr string, config *config) (*connPool, error) {
+	var factory func() (net.Conn, error)
+	if config.connFactory != nil {
+		factory = func() (net.Conn, error) {
+			return config.connFactory(addr)
+		}
+	}
+	return newConnPoolWithFactory(addr, config, factory)
+}
+
+//factory hands out conns already connected to addr, e.g. one end of a
+//net.Pipe, in place of dialing; nil dials addr as configured
+func newConnPoolWithFactory(addr string, config *config, factory func() (net.Conn, error)) (*connPool, error) {
+	if config.maxConns < MAXCONNS_LEAST {
 		return nil, fmt.Errorf("too little maxConns < %d", MAXCONNS_LEAST)
 	}
 	connPool := &connPool{
-		conns:    list.New(),
-		addr:     addr,
-		maxConns: maxConns,
-		lock:     &sync.RWMutex{},
-		finish:   make(chan bool),
+		conns:          list.New(),
+		waiters:        list.New(),
+		addr:           addr,
+		maxConns:       config.maxConns,
+		connectTimeout: config.connectTimeout,
+		tlsConfig:      config.tlsConfig,
+		dialContext:    config.dialContext,
+		factory:        factory,
+		maxIdleTime:    config.maxIdleTime,
+		waitTimeout:    config.poolWaitTimeout,
+		testOnBorrow:   config.testOnBorrow,
+		lock:           &sync.RWMutex{},
+		finish:         make(chan bool),
+		logger:         config.getLogger(),
+		metrics:        config.getMetrics(),
+		buffers:        config.buffers,
+	}
+	if connPool.connectTimeout <= 0 {
+		connPool.connectTimeout = DEFAULT_CONNECT_TIMEOUT
+	}
+	if connPool.factory == nil {
+		connPool.factory = connPool.dial
+	}
+	connPool.lock.Lock()
+	defer connPool.lock.Unlock()
+	for i := 0; i < MAXCONNS_LEAST; i++ {
+		if err := connPool.makeConn(); err != nil {
+			return nil, err
+		}
 	}
 	go func() {
 		timer := time.NewTimer(time.Second * 20)
+		var reap <-chan time.Time
+		if connPool.maxIdleTime > 0 {
+			interval := connPool.maxIdleTime / 2
+			if interval < minReapInterval {
+				interval = minReapInterval
+			}
+			reapTicker := time.NewTicker(interval)
+			defer reapTicker.Stop()
+			reap = reapTicker.C
+		}
 		for {
 			select {
 			case finish := <-connPool.finish:
@@ -52,24 +130,95 @@ func newConnPool(addr string, maxConns int) (*connPool, error) {
 			case <-timer.C:
 				connPool.CheckConns()
 				timer.Reset(time.Second * 20)
+			case <-reap:
+				connPool.reapIdleConns()
 			}
 		}
 	}()
-	connPool.lock.Lock()
-	defer connPool.lock.Unlock()
-	for i := 0; i < MAXCONNS_LEAST; i++ {
-		if err := connPool.makeConn(); err != nil {
-			return nil, err
-		}
-	}
 	return connPool, nil
 }
 
+// Deprecated: use Destroy.
 func (this *connPool) Destory() {
+	this.Destroy()
+}
+
+// Destroy closes the idle conns at once, borrowed ones are closed when they
+// are put back.
+func (this *connPool) Destroy() {
 	if this == nil {
 		return
 	}
-	this.finish <- true
+	this.close()
+	this.closeIdleConns()
+}
+
+// Close is Destroy that waits for the borrowed conns to be put back, until
+// ctx is done. No conn is handed out once it is called, and conns put back
+// afterwards are closed instead of pooled.
+func (this *connPool) Close(ctx context.Context) error {
+	this.close()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		this.closeIdleConns()
+		this.lock.RLock()
+		count := this.count
+		this.lock.RUnlock()
+		if count == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+//stop handing out conns and wake the waiters to fail
+func (this *connPool) close() {
+	this.stop.Do(func() {
+		this.finish <- true
+	})
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	for this.waiters.Len() > 0 {
+		this.notifyWaiter()
+	}
+}
+
+func (this *connPool) Stats() PoolStats {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return PoolStats{
+		Idle:         this.conns.Len(),
+		Open:         this.count,
+		MaxConns:     this.maxConns,
+		TotalCreated: this.created,
+	}
+}
+
+// SetMaxConns changes the pool cap at runtime. Shrinking closes idle conns
+// above the new cap at once, borrowed ones above it are closed when they are
+// put back. Growing lets waiters dial a new conn.
+func (this *connPool) SetMaxConns(maxConns int) error {
+	if maxConns < MAXCONNS_LEAST {
+		return fmt.Errorf("too little maxConns < %d", MAXCONNS_LEAST)
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.maxConns = maxConns
+	for e := this.conns.Front(); e != nil && this.count > this.maxConns; e = this.conns.Front() {
+		this.conns.Remove(e)
+		this.count--
+		e.Value.(pConn).Conn.Close()
+	}
+	for free := this.maxConns - this.count; free > 0 && this.waiters.Len() > 0; free-- {
+		this.notifyWaiter()
+	}
+	return nil
 }
 
 func (this *connPool) CheckConns() error {
@@ -78,64 +227,243 @@ func (this *connPool) CheckConns() error {
 	for e, next := this.conns.Front(), new(list.Element); e != nil; e = next {
 		next = e.Next()
 		conn := e.Value.(pConn)
-		header := &header{
-			cmd: FDFS_PROTO_CMD_ACTIVE_TEST,
-		}
-		if err := header.SendHeader(conn.Conn); err != nil {
-			this.conns.Remove(e)
-			this.count--
-			continue
-		}
-		if err := header.RecvHeader(conn.Conn); err != nil {
+		if err := activeTest(conn.Conn, this.connectTimeout); err != nil {
 			this.conns.Remove(e)
 			this.count--
+			conn.Conn.Close()
 			continue
 		}
-		if header.cmd != TRACKER_PROTO_CMD_RESP || header.status != 0 {
+	}
+	return nil
+}
+
+func activeTest(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	header := &header{
+		cmd: FDFS_PROTO_CMD_ACTIVE_TEST,
+	}
+	if err := header.SendHeader(conn); err != nil {
+		return err
+	}
+	if err := header.RecvHeader(conn); err != nil {
+		return err
+	}
+	if header.cmd != TRACKER_PROTO_CMD_RESP || header.status != 0 {
+		return fmt.Errorf("active test resp cmd %d status %d", header.cmd, header.status)
+	}
+	return nil
+}
+
+func (this *connPool) reapIdleConns() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for e, next := this.conns.Front(), new(list.Element); e != nil; e = next {
+		next = e.Next()
+		conn := e.Value.(pConn)
+		if this.isIdleExpired(conn) {
 			this.conns.Remove(e)
 			this.count--
-			continue
+			conn.Conn.Close()
 		}
 	}
-	return nil
+}
+
+func (this *connPool) closeIdleConns() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for e, next := this.conns.Front(), new(list.Element); e != nil; e = next {
+		next = e.Next()
+		this.conns.Remove(e)
+		this.count--
+		e.Value.(pConn).Conn.Close()
+	}
+}
+
+func (this *connPool) isIdleExpired(conn pConn) bool {
+	return this.maxIdleTime > 0 && time.Since(conn.lastUsed) > this.maxIdleTime
 }
 
 func (this *connPool) makeConn() error {
-	conn, err := net.DialTimeout("tcp", this.addr, time.Second*10)
+	conn, err := this.factory()
 	if err != nil {
+		this.logger.Warnf("fdfs: dial %s: %v", this.addr, err)
 		return err
 	}
+	this.logger.Debugf("fdfs: dialed %s, %d conns open", this.addr, this.count+1)
 	this.conns.PushBack(pConn{
-		Conn: conn,
-		pool: this,
+		Conn:     conn,
+		pool:     this,
+		lastUsed: time.Now(),
 	})
 	this.count++
+	this.created++
 	return nil
 }
 
+//connectTimeout covers the TLS handshake too
+func (this *connPool) dial() (net.Conn, error) {
+	deadline := time.Now().Add(this.connectTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	dialContext := this.dialContext
+	if dialContext == nil {
+		dialContext = (&net.Dialer{}).DialContext
+	}
+	conn, err := dialContext(ctx, "tcp", this.addr)
+	if err != nil || this.tlsConfig == nil {
+		return conn, err
+	}
+	tlsConfig := this.tlsConfig
+	if tlsConfig.ServerName == "" {
+		//as tls.Dial does, verify against the host dialed
+		host, _, _ := net.SplitHostPort(this.addr)
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// get never opens more than maxConns conns. With all of them borrowed it
+// fails at once, or with a waitTimeout waits that long for one to come back
+// and then fails with ErrPoolTimeout.
 func (this *connPool) get() (net.Conn, error) {
+	if this.waitTimeout <= 0 {
+		return this.take(context.Background(), false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), this.waitTimeout)
+	defer cancel()
+	conn, err := this.take(ctx, true)
+	if err == context.DeadlineExceeded {
+		return nil, ErrPoolTimeout
+	}
+	return conn, err
+}
+
+// getContext is get that waits for a conn to be put back or removed when
+// all maxConns are borrowed, where get fails at once with "reach maxConns".
+// It gives up with ctx.Err() once ctx is done.
+func (this *connPool) getContext(ctx context.Context) (net.Conn, error) {
+	return this.take(ctx, true)
+}
+
+func (this *connPool) take(ctx context.Context, wait bool) (net.Conn, error) {
+	var err error
+	this.lock.RLock()
+	maxConns := this.maxConns
+	this.lock.RUnlock()
+	//each failed test drops a conn, so maxConns+1 tries reach a fresh dial
+	for i := 0; i <= maxConns; {
+		conn, ready, borrowErr := this.borrow(wait)
+		if borrowErr != nil {
+			return nil, borrowErr
+		}
+		if ready != nil {
+			this.metrics.IncPoolWait()
+			if err := this.wait(ctx, ready); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		i++
+		if !this.testOnBorrow {
+			return conn, nil
+		}
+		if err = activeTest(conn.Conn, this.connectTimeout); err == nil {
+			return conn, nil
+		}
+		conn.discard()
+	}
+	return nil, fmt.Errorf("test on borrow %v", err)
+}
+
+//borrow hands out an idle conn or dials a new one. At maxConns it fails,
+//or with wait returns a channel signalled when a conn is put back or removed
+func (this *connPool) borrow(wait bool) (pConn, chan struct{}, error) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
+	if this.closed {
+		return pConn{}, nil, fmt.Errorf("connPool %s closed", this.addr)
+	}
 	for {
 		e := this.conns.Front()
 		if e == nil {
 			if this.count >= this.maxConns {
-				return nil, fmt.Errorf("reach maxConns %d", this.maxConns)
+				if wait {
+					ready := make(chan struct{}, 1)
+					this.waiters.PushBack(ready)
+					return pConn{}, ready, nil
+				}
+				this.logger.Warnf("fdfs: pool %s exhausted, %d conns in use", this.addr, this.count)
+				return pConn{}, nil, fmt.Errorf("reach maxConns %d", this.maxConns)
+			}
+			if err := this.makeConn(); err != nil {
+				return pConn{}, nil, err
 			}
-			this.makeConn()
 			continue
 		}
 		this.conns.Remove(e)
 		conn := e.Value.(pConn)
-		return conn, nil
+		if this.isIdleExpired(conn) {
+			this.count--
+			conn.Conn.Close()
+			continue
+		}
+		return conn, nil, nil
+	}
+}
+
+func (this *connPool) wait(ctx context.Context, ready chan struct{}) error {
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for e := this.waiters.Front(); e != nil; e = e.Next() {
+		if e.Value.(chan struct{}) == ready {
+			this.waiters.Remove(e)
+			return ctx.Err()
+		}
+	}
+	//signalled while giving up, pass it on
+	this.notifyWaiter()
+	return ctx.Err()
+}
+
+//must hold lock
+func (this *connPool) notifyWaiter() {
+	if e := this.waiters.Front(); e != nil {
+		this.waiters.Remove(e)
+		e.Value.(chan struct{}) <- struct{}{}
 	}
-	//not reach
-	return nil, nil
 }
 
 func (this *connPool) put(pConn pConn) error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
+	if this.closed || this.count > this.maxConns {
+		this.count--
+		return pConn.Conn.Close()
+	}
+	pConn.lastUsed = time.Now()
 	pConn.pool.conns.PushBack(pConn)
+	this.notifyWaiter()
 	return nil
 }
+
+func (this *connPool) remove(pConn pConn) error {
+	this.lock.Lock()
+	this.count--
+	this.notifyWaiter()
+	this.lock.Unlock()
+	return pConn.Conn.Close()
+}
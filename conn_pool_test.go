@@ -0,0 +1,392 @@
+package fdfs_client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnPoolGetContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	var borrowed []net.Conn
+	for i := 0; i < MAXCONNS_LEAST; i++ {
+		conn, err := pool.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		borrowed = append(borrowed, conn)
+	}
+	if _, err := pool.get(); err == nil {
+		t.Fatal("get succeeded on an exhausted pool")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.getContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("getContext = %v, want DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		borrowed[0].Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := pool.getContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.(pConn).Conn != borrowed[0].(pConn).Conn {
+		t.Fatal("getContext didn't get the conn put back")
+	}
+}
+
+func TestConnPoolClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Close(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Close with a borrowed conn = %v", err)
+	}
+	if _, err := pool.get(); err == nil {
+		t.Fatal("get succeeded after Close")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		conn.Close()
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Open != 0 {
+		t.Fatalf("%d conns still open", stats.Open)
+	}
+}
+
+func TestStoragePoolsByPort(t *testing.T) {
+	client := &Client{
+		storagePools:    make(map[string]*connPool),
+		storagePoolLock: &sync.RWMutex{},
+		closed:          new(bool),
+		config:          &config{maxConns: MAXCONNS_LEAST},
+	}
+	defer client.Destroy()
+	//two storage instances on one host
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		addrs = append(addrs, listener.Addr().String())
+	}
+	for _, addr := range addrs {
+		conn, err := client.getStorageConn(&StorageInfo{GroupName: "group1", Addr: addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.RemoteAddr().String(); got != addr {
+			t.Fatalf("conn to %s, want %s", got, addr)
+		}
+		conn.Close()
+	}
+	if len(client.storagePools) != 2 {
+		t.Fatalf("%d storage pools, want 2", len(client.storagePools))
+	}
+}
+
+func TestConnPoolWaitTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST, poolWaitTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	var borrowed []net.Conn
+	for i := 0; i < MAXCONNS_LEAST; i++ {
+		conn, err := pool.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		borrowed = append(borrowed, conn)
+	}
+	if _, err := pool.get(); err != ErrPoolTimeout {
+		t.Fatalf("get = %v, want ErrPoolTimeout", err)
+	}
+	if stats := pool.Stats(); stats.Open != MAXCONNS_LEAST {
+		t.Fatalf("%d conns open, maxConns %d", stats.Open, MAXCONNS_LEAST)
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		borrowed[0].Close()
+	}()
+	if _, err := pool.get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnPoolSetMaxConns(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: 2 * MAXCONNS_LEAST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	var borrowed []net.Conn
+	for i := 0; i < 2*MAXCONNS_LEAST; i++ {
+		conn, err := pool.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		borrowed = append(borrowed, conn)
+	}
+	borrowed[0].Close()
+	if err := pool.SetMaxConns(MAXCONNS_LEAST); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Idle != 0 || stats.Open != 2*MAXCONNS_LEAST-1 {
+		t.Fatalf("idle conn above the cap kept, %+v", stats)
+	}
+	for _, conn := range borrowed[1:] {
+		conn.Close()
+	}
+	if stats := pool.Stats(); stats.Open != MAXCONNS_LEAST || stats.MaxConns != MAXCONNS_LEAST {
+		t.Fatalf("after put back %+v", stats)
+	}
+	if err := pool.SetMaxConns(MAXCONNS_LEAST - 1); err == nil {
+		t.Fatal("SetMaxConns accepted a cap below MAXCONNS_LEAST")
+	}
+}
+
+func TestConnPoolTLS(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	tlsConfig := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+
+	pool, err := newConnPool(server.Listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST, tlsConfig: tlsConfig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	conn, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(pConn).Conn.(*tls.Conn); !ok {
+		t.Fatalf("pooled %T, want *tls.Conn", conn.(pConn).Conn)
+	}
+	if _, ok := tcpConnOf(conn); ok {
+		t.Fatal("tcpConnOf found a TCP conn under TLS")
+	}
+}
+
+func TestConnPoolDialContext(t *testing.T) {
+	var dialed []string
+	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("dial ctx without the connect timeout")
+		}
+		dialed = append(dialed, addr)
+		client, server := net.Pipe()
+		go server.Close()
+		return client, nil
+	}
+	pool, err := newConnPool("tracker.internal:22122", &config{maxConns: MAXCONNS_LEAST, dialContext: dialContext})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	if len(dialed) != MAXCONNS_LEAST || dialed[0] != "tracker.internal:22122" {
+		t.Fatalf("dialed %v", dialed)
+	}
+}
+
+func TestTrackerHostname(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+
+	client, err := NewClientWithOptions(WithTrackers([]string{addr}), WithMaxConns(MAXCONNS_LEAST))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+	//keyed by the configured name, resolved only when dialing
+	if stats, ok := client.PoolStats()[addr]; !ok || stats.Open != MAXCONNS_LEAST {
+		t.Fatalf("PoolStats = %+v", client.PoolStats())
+	}
+	conn, err := client.getTrackerConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != listener.Addr().String() {
+		t.Fatalf("conn to %s, want %s", got, listener.Addr())
+	}
+}
+
+type countingMetrics struct {
+	nopMetrics
+	poolWaits int32
+}
+
+func (this *countingMetrics) IncPoolWait() {
+	atomic.AddInt32(&this.poolWaits, 1)
+}
+
+func TestConnPoolWaitMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	metrics := &countingMetrics{}
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST, poolWaitTimeout: 10 * time.Millisecond, metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	for i := 0; i < MAXCONNS_LEAST; i++ {
+		if _, err := pool.get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&metrics.poolWaits) != 0 {
+		t.Fatal("counted a wait before the pool was exhausted")
+	}
+	pool.get()
+	if atomic.LoadInt32(&metrics.poolWaits) != 1 {
+		t.Fatalf("%d pool waits, want 1", metrics.poolWaits)
+	}
+}
+
+func TestClientWith(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := NewClientWithOptions(WithTrackers([]string{listener.Addr().String()}), WithMaxConns(MAXCONNS_LEAST), WithNetworkTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	strict := client.With(WithNetworkTimeout(time.Second))
+	if strict.config.networkTimeout != time.Second || client.config.networkTimeout != time.Minute {
+		t.Fatalf("network timeouts %v and %v", strict.config.networkTimeout, client.config.networkTimeout)
+	}
+	if strict.trackerPools.get()[0] != client.trackerPools.get()[0] {
+		t.Fatal("With dialed its own tracker pool")
+	}
+	if stats := client.PoolStats()[listener.Addr().String()]; stats.TotalCreated != MAXCONNS_LEAST {
+		t.Fatalf("%d conns created, want %d", stats.TotalCreated, MAXCONNS_LEAST)
+	}
+
+	strict.Destroy()
+	if _, err := client.getStorageConn(&StorageInfo{Addr: listener.Addr().String()}); err == nil {
+		t.Fatal("storage conn after the derived client was destroyed")
+	}
+}
+
+func TestConnPoolFactory(t *testing.T) {
+	server := newTestServer(t)
+	var made int32
+	//in-process conns, nothing is dialed
+	factory := func() (net.Conn, error) {
+		atomic.AddInt32(&made, 1)
+		client, conn := net.Pipe()
+		go server.ServeConn(conn)
+		return client, nil
+	}
+	pool, err := newConnPoolWithFactory("pipe", &config{maxConns: MAXCONNS_LEAST}, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+	if made != MAXCONNS_LEAST {
+		t.Fatalf("factory called %d times, want %d", made, MAXCONNS_LEAST)
+	}
+	conn, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := activeTest(conn, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnPoolMaxIdleTime(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	config := &config{maxConns: MAXCONNS_LEAST}
+	//too short to halve into a ticker period
+	WithMaxIdleTime(time.Nanosecond)(config)
+	pool, err := newConnPool(listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	for deadline := time.Now().Add(time.Second); pool.Stats().Open > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle conns not reaped, %+v", pool.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
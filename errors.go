@@ -0,0 +1,68 @@
+package fdfs_client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrFileNotFound matches a StatusError for a file the server doesn't have.
+	ErrFileNotFound = errors.New("fdfs: file not found")
+	// ErrNoAvailableTracker is returned when no tracker could be connected.
+	ErrNoAvailableTracker = errors.New("fdfs: no available tracker")
+	// ErrNoAvailableStorage matches a StatusError for a store query the
+	// tracker could not serve, e.g. an unknown group or every storage full.
+	ErrNoAvailableStorage = errors.New("fdfs: no available storage")
+	// ErrPoolTimeout is returned when every conn of a pool stayed borrowed
+	// for the whole pool_wait_timeout.
+	ErrPoolTimeout = errors.New("fdfs: timed out waiting for a pool conn")
+	// ErrFileTooLarge is returned for an upload over max_file_size, before
+	// any of it is sent.
+	ErrFileTooLarge = errors.New("fdfs: file too large")
+	// ErrFileExists is returned by a download to a file that already exists
+	// under the FailIfExists policy.
+	ErrFileExists = errors.New("fdfs: local file exists")
+	// ErrCircuitOpen is returned at once for a storage that kept failing,
+	// until its breaker cooldown is over.
+	ErrCircuitOpen = errors.New("fdfs: storage circuit open")
+)
+
+const (
+	statusENOENT = 2
+	statusENOSPC = 28
+)
+
+// StatusError is returned when a tracker or storage answers with a non-zero
+// status byte. Status carries the server errno, e.g. 2 (ENOENT) when the
+// file does not exist. Use errors.Is with the Err* values above to test for
+// the common cases.
+type StatusError struct {
+	Cmd    int8
+	Status int8
+}
+
+// ShortReadError is returned when a conn closes before delivering the body
+// size announced in the response header. Got bytes were received, and
+// handed to the writer if there was one.
+type ShortReadError struct {
+	Expected int64
+	Got      int64
+}
+
+func (this *ShortReadError) Error() string {
+	return fmt.Sprintf("short read, got %d of %d bytes", this.Got, this.Expected)
+}
+
+func (this *StatusError) Error() string {
+	return fmt.Sprintf("cmd %d recv resp status %d != 0", this.Cmd, this.Status)
+}
+
+func (this *StatusError) Is(target error) bool {
+	switch this.Cmd {
+	case TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE,
+		TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITH_GROUP_ONE:
+		return target == ErrNoAvailableStorage &&
+			(this.Status == statusENOENT || this.Status == statusENOSPC)
+	}
+	return target == ErrFileNotFound && this.Status == statusENOENT
+}
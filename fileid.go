@@ -0,0 +1,94 @@
+package fdfs_client
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// FileId names a stored file by its group and the remote filename the
+// storage assigned, as returned by uploads in "group/remote" form.
+type FileId struct {
+	GroupName      string
+	RemoteFilename string
+}
+
+func ParseFileId(fileId string) (FileId, error) {
+	groupName, remoteFilename, err := splitFileId(fileId)
+	if err != nil {
+		return FileId{}, err
+	}
+	return FileId{GroupName: groupName, RemoteFilename: remoteFilename}, nil
+}
+
+// JoinFileId is the canonical "group/remote" fileId of a file.
+func JoinFileId(groupName string, remoteFilename string) (string, error) {
+	if err := checkFileId(groupName, remoteFilename); err != nil {
+		return "", err
+	}
+	return groupName + "/" + remoteFilename, nil
+}
+
+func (this FileId) String() string {
+	return this.GroupName + "/" + this.RemoteFilename
+}
+
+// URL is the HTTP link of the file below baseDomain, e.g.
+// "http://img.example.com/group1/M00/00/00/xxx.jpg".
+func (this FileId) URL(baseDomain string) string {
+	return strings.TrimRight(baseDomain, "/") + "/" +
+		strings.Trim(this.GroupName, "/") + "/" +
+		strings.TrimLeft(this.RemoteFilename, "/")
+}
+
+// MarshalJSON writes the canonical "group/remote" string, the zero FileId
+// as "".
+func (this FileId) MarshalJSON() ([]byte, error) {
+	if this == (FileId{}) {
+		return json.Marshal("")
+	}
+	return json.Marshal(this.String())
+}
+
+func (this *FileId) UnmarshalJSON(data []byte) error {
+	var fileId string
+	if err := json.Unmarshal(data, &fileId); err != nil {
+		return err
+	}
+	if fileId == "" {
+		//"" and null
+		*this = FileId{}
+		return nil
+	}
+	parsed, err := ParseFileId(fileId)
+	if err != nil {
+		return err
+	}
+	*this = parsed
+	return nil
+}
+
+// UploadResult is an uploaded file with the storage that took it. Size and
+// Crc32 are decoded from the remote filename, appender files have no Crc32
+// there and report 0. StorePathIndex is -1 when the storage picked the path.
+type UploadResult struct {
+	FileId         FileId
+	StorageAddr    string
+	StorePathIndex int8
+	Size           int64
+	Crc32          uint32
+}
+
+// DownloadResult is a file downloaded to disk. Size is the byte count the
+// storage announced and was written, LocalFilename the absolute path.
+type DownloadResult struct {
+	LocalFilename string
+	Size          int64
+}
+
+// Location is a file together with the storage the tracker picked to fetch
+// it from, as returned by Client.Locate. Passing it to the *FromLocation
+// methods skips the tracker for each of them.
+type Location struct {
+	FileId  FileId
+	Storage StorageInfo
+}
@@ -0,0 +1,103 @@
+package fdfs_client
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFileIdURL(t *testing.T) {
+	for _, s := range []string{"group1/M00/00/00/a.jpg", "group1:M00/00/00/a.jpg"} {
+		fileId, err := ParseFileId(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileId.String() != "group1/M00/00/00/a.jpg" {
+			t.Fatalf("ParseFileId(%q) = %q", s, fileId)
+		}
+		if url := fileId.URL("http://img.example.com/"); url != "http://img.example.com/group1/M00/00/00/a.jpg" {
+			t.Fatalf("URL = %q", url)
+		}
+	}
+	if _, err := ParseFileId("group1"); err == nil {
+		t.Fatal("ParseFileId accepted a fileId without remote filename")
+	}
+}
+
+func TestSplitFileId(t *testing.T) {
+	tests := []struct {
+		fileId         string
+		groupName      string
+		remoteFilename string
+		ok             bool
+	}{
+		{"group1/M00/00/00/a.jpg", "group1", "M00/00/00/a.jpg", true},
+		{"group1:M00/00/00/a.jpg", "group1", "M00/00/00/a.jpg", true},
+		{"0123456789abcdef/M00/00/00/a.jpg", "0123456789abcdef", "M00/00/00/a.jpg", true},
+		{"0123456789abcdefg/M00/00/00/a.jpg", "", "", false},
+		{"group1", "", "", false},
+		{"group1/", "", "", false},
+		{"/group1/M00/00/00/a.jpg", "", "", false},
+		{"group1//M00/00/00/a.jpg", "", "", false},
+		{"", "", "", false},
+		{"group1/M00/00/00/" + strings.Repeat("a", FDFS_REMOTE_NAME_MAX_SIZE-10), "group1", "M00/00/00/" + strings.Repeat("a", FDFS_REMOTE_NAME_MAX_SIZE-10), true},
+		{"group1/M00/00/00/" + strings.Repeat("a", 1<<20), "", "", false},
+	}
+	for _, test := range tests {
+		groupName, remoteFilename, err := splitFileId(test.fileId)
+		if (err == nil) != test.ok {
+			t.Errorf("splitFileId(%q) error %v", test.fileId, err)
+			continue
+		}
+		if groupName != test.groupName || remoteFilename != test.remoteFilename {
+			t.Errorf("splitFileId(%q) = %q, %q", test.fileId, groupName, remoteFilename)
+		}
+	}
+}
+
+func TestJoinFileId(t *testing.T) {
+	tests := []struct {
+		groupName      string
+		remoteFilename string
+		fileId         string
+		ok             bool
+	}{
+		{"group1", "M00/00/00/a.jpg", "group1/M00/00/00/a.jpg", true},
+		{"", "M00/00/00/a.jpg", "", false},
+		{"group1", "", "", false},
+		{"group1", "/M00/00/00/a.jpg", "", false},
+		{"group:1", "M00/00/00/a.jpg", "", false},
+		{"0123456789abcdefg", "M00/00/00/a.jpg", "", false},
+	}
+	for _, test := range tests {
+		fileId, err := JoinFileId(test.groupName, test.remoteFilename)
+		if (err == nil) != test.ok || fileId != test.fileId {
+			t.Errorf("JoinFileId(%q, %q) = %q, %v", test.groupName, test.remoteFilename, fileId, err)
+		}
+	}
+}
+
+func TestFileIdJSON(t *testing.T) {
+	var doc struct {
+		File  FileId
+		Empty FileId
+	}
+	doc.File = FileId{GroupName: "group1", RemoteFilename: "M00/00/00/a.jpg"}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"File":"group1/M00/00/00/a.jpg","Empty":""}` {
+		t.Fatalf("Marshal = %s", data)
+	}
+	doc.File = FileId{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.File.GroupName != "group1" || doc.File.RemoteFilename != "M00/00/00/a.jpg" {
+		t.Fatalf("Unmarshal = %+v", doc.File)
+	}
+	if err := json.Unmarshal([]byte(`{"File":"group1"}`), &doc); err == nil {
+		t.Fatal("Unmarshal accepted an invalid fileId")
+	}
+}
@@ -0,0 +1,546 @@
+// Package testserver is an in-memory FastDFS tracker and storage in one, for
+// round trip tests of the client. It speaks just enough of the protocol:
+// store, fetch and update queries answer with the storage address, the
+// storage keeps files and metadata in memory, and failures can be injected
+// per command.
+package testserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cmdListGroups       = 91
+	cmdResp             = 100
+	cmdQueryStore       = 101
+	cmdQueryFetchOne    = 102
+	cmdQueryUpdate      = 103
+	cmdQueryStoreGroup  = 104
+	cmdQueryFetchAll    = 105
+	cmdUpload           = 11
+	cmdDelete           = 12
+	cmdSetMetadata      = 13
+	cmdDownload         = 14
+	cmdGetMetadata      = 15
+	cmdQueryFileInfo    = 22
+	cmdUploadAppender   = 23
+	cmdAppend           = 24
+	cmdModify           = 34
+	cmdTruncate         = 36
+	cmdActiveTest       = 111
+	groupNameLen        = 16
+	ipAddressSize       = 16
+	appenderFileSizeBit = 1 << 58
+	recordSeparator     = 1
+	fieldSeparator      = 2
+
+	statusENOENT = 2
+	statusEINVAL = 22
+)
+
+var fdfsBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_").WithPadding(base64.NoPadding)
+
+// Server is a running test server, see NewTestServer.
+type Server struct {
+	addr           string
+	groupName      string
+	lock           sync.Mutex
+	listener       net.Listener
+	conns          map[net.Conn]struct{}
+	storageAddrs   []string
+	storePathCount int
+	storeQueries   int
+	files          map[string][]byte
+	metas          map[string]map[string]string
+	seq            uint32
+	failures       map[int8]int8
+	drops          int
+	requests       map[int8]int
+	pathIndexes    []byte
+}
+
+// NewTestServer listens on a free port of 127.0.0.1 and serves until Close.
+// It is the only tracker and the only storage of group1, with 2 store paths.
+func NewTestServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
+		addr:           listener.Addr().String(),
+		groupName:      "group1",
+		conns:          make(map[net.Conn]struct{}),
+		storePathCount: 2,
+		files:          make(map[string][]byte),
+		metas:          make(map[string]map[string]string),
+		failures:       make(map[int8]int8),
+		requests:       make(map[int8]int),
+	}
+	server.start(listener)
+	return server, nil
+}
+
+// Addr is the host:port of the server, as tracker and as storage.
+func (this *Server) Addr() string {
+	return this.addr
+}
+
+// Close stops listening and drops every open conn, the files are kept for
+// Restart.
+func (this *Server) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var err error
+	if this.listener != nil {
+		err = this.listener.Close()
+		this.listener = nil
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Restart listens again on Addr after Close, as a storage coming back.
+func (this *Server) Restart() error {
+	listener, err := net.Listen("tcp", this.addr)
+	if err != nil {
+		return err
+	}
+	this.start(listener)
+	return nil
+}
+
+func (this *Server) start(listener net.Listener) {
+	this.lock.Lock()
+	this.listener = listener
+	this.lock.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go this.ServeConn(conn)
+		}
+	}()
+}
+
+// SetStorage makes tracker queries answer with the storages at addrs, e.g.
+// other Servers, instead of this one. Store queries take turns over them,
+// fetch and update queries always answer with the first.
+func (this *Server) SetStorage(addrs ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.storageAddrs = append([]string(nil), addrs...)
+}
+
+// Fail answers every later request of cmd with status and no body, until
+// Fail(cmd, 0).
+func (this *Server) Fail(cmd int8, status int8) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if status == 0 {
+		delete(this.failures, cmd)
+		return
+	}
+	this.failures[cmd] = status
+}
+
+// Drop hangs up on the next n requests without answering, a transport
+// failure to the client.
+func (this *Server) Drop(n int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.drops = n
+}
+
+// Requests counts the requests of cmd received so far, dropped and failed
+// ones included.
+func (this *Server) Requests(cmd int8) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests[cmd]
+}
+
+// PathIndexes lists the store path index byte of every upload received.
+func (this *Server) PathIndexes() []byte {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]byte(nil), this.pathIndexes...)
+}
+
+// File is the content stored for fileId.
+func (this *Server) File(fileId string) ([]byte, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	content, ok := this.files[this.remoteFilenameOf(fileId)]
+	return append([]byte(nil), content...), ok
+}
+
+// Files counts the files stored.
+func (this *Server) Files() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.files)
+}
+
+func (this *Server) remoteFilenameOf(fileId string) string {
+	prefix := this.groupName + "/"
+	if len(fileId) > len(prefix) && fileId[:len(prefix)] == prefix {
+		return fileId[len(prefix):]
+	}
+	return fileId
+}
+
+// ServeConn answers the requests on conn until it fails, e.g. for the far
+// end of a net.Pipe.
+func (this *Server) ServeConn(conn net.Conn) {
+	this.lock.Lock()
+	this.conns[conn] = struct{}{}
+	this.lock.Unlock()
+	defer func() {
+		this.lock.Lock()
+		delete(this.conns, conn)
+		this.lock.Unlock()
+		conn.Close()
+	}()
+	for {
+		var header [10]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		pkgLen := int64(binary.BigEndian.Uint64(header[:8]))
+		cmd := int8(header[8])
+		if pkgLen < 0 {
+			return
+		}
+
+		this.lock.Lock()
+		this.requests[cmd]++
+		drop := this.drops > 0
+		if drop {
+			this.drops--
+		}
+		failure, fail := this.failures[cmd]
+		this.lock.Unlock()
+		if drop {
+			return
+		}
+
+		body := make([]byte, pkgLen)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		status, res := failure, []byte(nil)
+		if !fail {
+			status, res = this.handle(cmd, body)
+		}
+		if err := writeResponse(conn, status, res); err != nil {
+			return
+		}
+	}
+}
+
+func writeResponse(conn net.Conn, status int8, res []byte) error {
+	var header [10]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(len(res)))
+	header[8] = cmdResp
+	header[9] = byte(status)
+	_, err := conn.Write(append(header[:], res...))
+	return err
+}
+
+func (this *Server) handle(cmd int8, body []byte) (int8, []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	switch cmd {
+	case cmdActiveTest:
+		return 0, nil
+	case cmdListGroups:
+		return 0, this.groupRecord()
+	case cmdQueryStore, cmdQueryStoreGroup:
+		//rotates over the store paths as a tracker with store_path=0 does
+		pathIndex := byte(this.storeQueries % this.storePathCount)
+		record := this.storageRecord(this.storeQueries)
+		this.storeQueries++
+		return 0, append(record, pathIndex)
+	case cmdQueryFetchOne, cmdQueryUpdate, cmdQueryFetchAll:
+		return 0, this.storageRecord(0)
+	case cmdUpload:
+		return this.upload(body, false)
+	case cmdUploadAppender:
+		return this.upload(body, true)
+	case cmdDownload:
+		return this.download(body)
+	case cmdDelete:
+		return this.delete(body)
+	case cmdQueryFileInfo:
+		return this.queryFileInfo(body)
+	case cmdSetMetadata:
+		return this.setMetadata(body)
+	case cmdGetMetadata:
+		return this.getMetadata(body)
+	case cmdAppend:
+		return this.append(body)
+	case cmdModify:
+		return this.modify(body)
+	case cmdTruncate:
+		return this.truncate(body)
+	}
+	return statusEINVAL, nil
+}
+
+func (this *Server) groupNameBytes() []byte {
+	groupName := make([]byte, groupNameLen)
+	copy(groupName, this.groupName)
+	return groupName
+}
+
+//the stat of its only group, zero but for the store path count
+func (this *Server) groupRecord() []byte {
+	buffer := new(bytes.Buffer)
+	buffer.Write(this.groupNameBytes())
+	buffer.WriteByte(0)
+	stats := make([]int64, 11)
+	stats[8] = int64(this.storePathCount)
+	binary.Write(buffer, binary.BigEndian, stats)
+	return buffer.Bytes()
+}
+
+//group, ip and port of the turn-th storage, as a tracker answers
+func (this *Server) storageRecord(turn int) []byte {
+	addr := this.addr
+	if len(this.storageAddrs) > 0 {
+		addr = this.storageAddrs[turn%len(this.storageAddrs)]
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.ParseInt(port, 10, 64)
+	buffer := new(bytes.Buffer)
+	buffer.Write(this.groupNameBytes())
+	ip := make([]byte, ipAddressSize-1)
+	copy(ip, host)
+	buffer.Write(ip)
+	binary.Write(buffer, binary.BigEndian, portNum)
+	return buffer.Bytes()
+}
+
+func (this *Server) upload(body []byte, appender bool) (int8, []byte) {
+	if len(body) < 15 {
+		return statusEINVAL, nil
+	}
+	this.pathIndexes = append(this.pathIndexes, body[0])
+	pathIndex := int(body[0])
+	if body[0] == 0xFF {
+		//the storage's own choice
+		pathIndex = 0
+	}
+	if pathIndex >= this.storePathCount {
+		return statusEINVAL, nil
+	}
+	fileSize := int64(binary.BigEndian.Uint64(body[1:9]))
+	fileExtName := string(bytes.TrimRight(body[9:15], "\x00"))
+	content := body[15:]
+	if int64(len(content)) != fileSize {
+		return statusEINVAL, nil
+	}
+
+	//the detail real storages encode, so the client can decode it
+	var detail [20]byte
+	copy(detail[:4], net.IPv4(127, 0, 0, 1).To4())
+	this.seq++
+	binary.BigEndian.PutUint32(detail[4:8], uint32(time.Now().Unix())+this.seq)
+	encodedSize := uint64(fileSize)
+	if appender {
+		encodedSize |= appenderFileSizeBit
+	}
+	binary.BigEndian.PutUint64(detail[8:16], encodedSize)
+	binary.BigEndian.PutUint32(detail[16:20], crc32.ChecksumIEEE(content))
+	remoteFilename := fmt.Sprintf("M%02X/00/00/", pathIndex) + fdfsBase64.EncodeToString(detail[:])
+	if fileExtName != "" {
+		remoteFilename += "." + fileExtName
+	}
+	this.files[remoteFilename] = append([]byte(nil), content...)
+	return 0, append(this.groupNameBytes(), remoteFilename...)
+}
+
+//group and remote filename, the tail of most storage requests
+func (this *Server) file(body []byte) (string, []byte, bool) {
+	if len(body) < groupNameLen {
+		return "", nil, false
+	}
+	remoteFilename := string(body[groupNameLen:])
+	content, ok := this.files[remoteFilename]
+	return remoteFilename, content, ok
+}
+
+func (this *Server) download(body []byte) (int8, []byte) {
+	if len(body) < 16 {
+		return statusEINVAL, nil
+	}
+	offset := int64(binary.BigEndian.Uint64(body[:8]))
+	downloadBytes := int64(binary.BigEndian.Uint64(body[8:16]))
+	_, content, ok := this.file(body[16:])
+	if !ok {
+		return statusENOENT, nil
+	}
+	if downloadBytes == 0 {
+		downloadBytes = int64(len(content)) - offset
+	}
+	if offset < 0 || downloadBytes < 0 || offset+downloadBytes > int64(len(content)) {
+		return statusEINVAL, nil
+	}
+	return 0, content[offset : offset+downloadBytes]
+}
+
+func (this *Server) delete(body []byte) (int8, []byte) {
+	remoteFilename, _, ok := this.file(body)
+	if !ok {
+		return statusENOENT, nil
+	}
+	delete(this.files, remoteFilename)
+	delete(this.metas, remoteFilename)
+	return 0, nil
+}
+
+func (this *Server) queryFileInfo(body []byte) (int8, []byte) {
+	_, content, ok := this.file(body)
+	if !ok {
+		return statusENOENT, nil
+	}
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.BigEndian, int64(len(content)))
+	binary.Write(buffer, binary.BigEndian, time.Now().Unix())
+	binary.Write(buffer, binary.BigEndian, int64(crc32.ChecksumIEEE(content)))
+	ip := make([]byte, ipAddressSize)
+	copy(ip, "127.0.0.1")
+	buffer.Write(ip)
+	return 0, buffer.Bytes()
+}
+
+func (this *Server) setMetadata(body []byte) (int8, []byte) {
+	if len(body) < 17+groupNameLen {
+		return statusEINVAL, nil
+	}
+	nameLen := int64(binary.BigEndian.Uint64(body[:8]))
+	metaLen := int64(binary.BigEndian.Uint64(body[8:16]))
+	flag := body[16]
+	rest := body[17+groupNameLen:]
+	if nameLen < 0 || metaLen < 0 || nameLen+metaLen != int64(len(rest)) {
+		return statusEINVAL, nil
+	}
+	remoteFilename := string(rest[:nameLen])
+	if _, ok := this.files[remoteFilename]; !ok {
+		return statusENOENT, nil
+	}
+	meta := this.metas[remoteFilename]
+	if flag == 'O' || meta == nil {
+		meta = make(map[string]string)
+	}
+	for _, record := range bytes.Split(rest[nameLen:], []byte{recordSeparator}) {
+		if fields := bytes.SplitN(record, []byte{fieldSeparator}, 2); len(fields) == 2 {
+			meta[string(fields[0])] = string(fields[1])
+		}
+	}
+	this.metas[remoteFilename] = meta
+	return 0, nil
+}
+
+func (this *Server) getMetadata(body []byte) (int8, []byte) {
+	remoteFilename, _, ok := this.file(body)
+	if !ok {
+		return statusENOENT, nil
+	}
+	meta := this.metas[remoteFilename]
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buffer := new(bytes.Buffer)
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(recordSeparator)
+		}
+		buffer.WriteString(key)
+		buffer.WriteByte(fieldSeparator)
+		buffer.WriteString(meta[key])
+	}
+	return 0, buffer.Bytes()
+}
+
+//remote filename length and the given number of int64s, then the remote
+//filename and the content
+func (this *Server) appenderRequest(body []byte, fields int) (string, []int64, []byte, bool) {
+	if len(body) < 8*(fields+1) {
+		return "", nil, nil, false
+	}
+	nameLen := int64(binary.BigEndian.Uint64(body[:8]))
+	values := make([]int64, fields)
+	for i := range values {
+		values[i] = int64(binary.BigEndian.Uint64(body[8*(i+1):]))
+	}
+	rest := body[8*(fields+1):]
+	if nameLen < 0 || nameLen > int64(len(rest)) {
+		return "", nil, nil, false
+	}
+	return string(rest[:nameLen]), values, rest[nameLen:], true
+}
+
+func (this *Server) append(body []byte) (int8, []byte) {
+	remoteFilename, values, content, ok := this.appenderRequest(body, 1)
+	if !ok || values[0] != int64(len(content)) {
+		return statusEINVAL, nil
+	}
+	old, ok := this.files[remoteFilename]
+	if !ok {
+		return statusENOENT, nil
+	}
+	this.files[remoteFilename] = append(old, content...)
+	return 0, nil
+}
+
+func (this *Server) modify(body []byte) (int8, []byte) {
+	remoteFilename, values, content, ok := this.appenderRequest(body, 2)
+	if !ok || values[1] != int64(len(content)) {
+		return statusEINVAL, nil
+	}
+	old, ok := this.files[remoteFilename]
+	if !ok {
+		return statusENOENT, nil
+	}
+	//as a real storage, within the current size only
+	offset := values[0]
+	if offset < 0 || offset+int64(len(content)) > int64(len(old)) {
+		return statusEINVAL, nil
+	}
+	copy(old[offset:], content)
+	return 0, nil
+}
+
+func (this *Server) truncate(body []byte) (int8, []byte) {
+	remoteFilename, values, rest, ok := this.appenderRequest(body, 1)
+	if !ok || len(rest) != 0 {
+		return statusEINVAL, nil
+	}
+	old, ok := this.files[remoteFilename]
+	if !ok {
+		return statusENOENT, nil
+	}
+	//a real storage refuses to grow the file
+	if values[0] < 0 || values[0] > int64(len(old)) {
+		return statusEINVAL, nil
+	}
+	this.files[remoteFilename] = old[:values[0]]
+	return 0, nil
+}
@@ -0,0 +1,28 @@
+package fdfs_client
+
+import (
+	"time"
+)
+
+// Metrics receives a measurement of every upload and download, retries
+// included in dur, and a count of the times a caller had to wait for a pool
+// conn, for adapting to Prometheus or OpenTelemetry. The default discards
+// everything. Implementations are called from many goroutines at once.
+type Metrics interface {
+	ObserveUpload(bytes int64, dur time.Duration, err error)
+	ObserveDownload(bytes int64, dur time.Duration, err error)
+	IncPoolWait()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveUpload(bytes int64, dur time.Duration, err error)   {}
+func (nopMetrics) ObserveDownload(bytes int64, dur time.Duration, err error) {}
+func (nopMetrics) IncPoolWait()                                              {}
+
+func (this *config) getMetrics() Metrics {
+	if this.metrics == nil {
+		return nopMetrics{}
+	}
+	return this.metrics
+}
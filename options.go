@@ -0,0 +1,240 @@
+package fdfs_client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+)
+
+// Option configures a client built by NewClientWithOptions.
+type Option func(*config)
+
+// WithTrackers sets the tracker addresses, each as "host:port".
+func WithTrackers(addrs []string) Option {
+	return func(c *config) {
+		c.trackerAddr = append([]string(nil), addrs...)
+	}
+}
+
+// WithMaxConns sets the size of every tracker and storage pool, like
+// maxConns in the config file. It defaults to DEFAULT_MAX_CONNS.
+func WithMaxConns(maxConns int) Option {
+	return func(c *config) {
+		c.maxConns = maxConns
+	}
+}
+
+// WithConnectTimeout bounds dialing a tracker or storage.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.connectTimeout = d
+	}
+}
+
+// WithNetworkTimeout bounds every send and receive phase of a task.
+func WithNetworkTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.networkTimeout = d
+	}
+}
+
+// WithUploadTimeout bounds a whole upload, retries included, like
+// upload_timeout in the config file. A deadline on the call's context wins.
+func WithUploadTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.uploadTimeout = d
+	}
+}
+
+// WithDownloadTimeout is WithUploadTimeout for downloads, like
+// download_timeout in the config file.
+func WithDownloadTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.downloadTimeout = d
+	}
+}
+
+// WithMaxRetries sets how many times an operation failing with a transport
+// error is tried again, like max_retries in the config file. 0 fails at once.
+func WithMaxRetries(maxRetries int) Option {
+	return func(c *config) {
+		c.maxRetries = maxRetries
+	}
+}
+
+// WithRetryInterval sets the sleep before each retry, like retry_interval in
+// the config file.
+func WithRetryInterval(d time.Duration) Option {
+	return func(c *config) {
+		c.retryInterval = d
+	}
+}
+
+// WithRetryBackoff doubles the retry interval after every retry, like
+// retry_backoff in the config file.
+func WithRetryBackoff(backoff bool) Option {
+	return func(c *config) {
+		c.retryBackoff = backoff
+	}
+}
+
+// WithPoolWaitTimeout makes a pool at maxConns wait up to d for a conn to
+// be given back before failing with ErrPoolTimeout, like pool_wait_timeout
+// in the config file. 0 fails at once.
+func WithPoolWaitTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.poolWaitTimeout = d
+	}
+}
+
+// WithMaxIdleTime closes pooled conns left unused for longer than d, like
+// max_idle_time in the config file. 0 keeps them.
+func WithMaxIdleTime(d time.Duration) Option {
+	return func(c *config) {
+		c.maxIdleTime = d
+	}
+}
+
+// WithTestOnBorrow sends an active test on every pooled conn before handing
+// it out, dropping the ones that fail, like test_on_borrow in the config file.
+func WithTestOnBorrow(test bool) Option {
+	return func(c *config) {
+		c.testOnBorrow = test
+	}
+}
+
+// WithDownloadDirPerm sets the perm of the parent dirs a download to file
+// creates, like download_dir_perm in the config file, 0755 by default.
+func WithDownloadDirPerm(perm os.FileMode) Option {
+	return func(c *config) {
+		c.downloadDirPerm = perm
+	}
+}
+
+// WithDownloadInPlace writes a download to file straight to its name instead
+// of renaming a complete temp file over it, like download_in_place in the
+// config file.
+func WithDownloadInPlace(inPlace bool) Option {
+	return func(c *config) {
+		c.downloadInPlace = inPlace
+	}
+}
+
+// WithStoreCacheTTL reuses the storage the tracker picked for uploads to a
+// group for ttl, like store_cache_ttl in the config file. Uploads served from
+// the cache leave the store path to the storage rather than reuse the
+// tracker's pick. 0, the default, asks the tracker for every upload.
+func WithStoreCacheTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.storeCacheTTL = ttl
+	}
+}
+
+// WithTLS dials every tracker and storage over TLS with tlsConfig, e.g.
+// through stunnel in front of the servers. The protocol above is unchanged.
+func WithTLS(tlsConfig *tls.Config) Option {
+	return func(c *config) {
+		c.tlsConfig = tlsConfig
+	}
+}
+
+// WithDialContext replaces the dialer of every tracker and storage pool, e.g.
+// to go through a SOCKS proxy or to hand out in-memory conns in tests. ctx
+// carries the connect timeout. With WithTLS the handshake runs over the conns
+// it returns.
+func WithDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(c *config) {
+		c.dialContext = dialContext
+	}
+}
+
+// WithConnFactory makes every tracker and storage pool take its conns from
+// factory, already connected to addr, instead of dialing, e.g. for exotic
+// transports or in-process servers. Neither the connect timeout nor WithTLS
+// applies to them.
+func WithConnFactory(factory func(addr string) (net.Conn, error)) Option {
+	return func(c *config) {
+		c.connFactory = factory
+	}
+}
+
+// WithCircuitBreaker fails requests to a storage at once for cooldown after
+// failures transport errors in a row within window, failed dials and pool
+// timeouts included, so downloads go to the other replicas instead of
+// waiting for timeouts. failures 0, the default, disables it.
+func WithCircuitBreaker(failures int, window time.Duration, cooldown time.Duration) Option {
+	return func(c *config) {
+		c.breakerFailures = failures
+		c.breakerWindow = window
+		c.breakerCooldown = cooldown
+	}
+}
+
+// WithMetrics sends upload, download and pool wait measurements to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(c *config) {
+		c.metrics = metrics
+	}
+}
+
+// WithOverwritePolicy chooses what a download does to a local file that
+// already exists, like download_overwrite in the config file.
+func WithOverwritePolicy(policy OverwritePolicy) Option {
+	return func(c *config) {
+		c.overwritePolicy = policy
+	}
+}
+
+// WithStorageIds turns on use_storage_id with the id to address mapping of
+// storage_ids.conf, an address without a port uses the one of the tracker.
+func WithStorageIds(storageIds map[string]string) Option {
+	return func(c *config) {
+		c.useStorageId = true
+		c.storageIds = make(map[string]string, len(storageIds))
+		for id, addr := range storageIds {
+			c.storageIds[id] = addr
+		}
+	}
+}
+
+// WithLogger sends the client's diagnostics to logger.
+func WithLogger(logger Logger) Option {
+	return func(c *config) {
+		c.logger = logger
+	}
+}
+
+// WithDefaultExtName sets the extension of uploads that have none, like
+// default_ext_name in the config file.
+func WithDefaultExtName(fileExtName string) Option {
+	return func(c *config) {
+		c.defaultExtName = fileExtName
+	}
+}
+
+// WithMaxFileSize refuses uploads over maxFileSize bytes with
+// ErrFileTooLarge, like max_file_size in the config file. 0 is unlimited.
+func WithMaxFileSize(maxFileSize int64) Option {
+	return func(c *config) {
+		c.maxFileSize = maxFileSize
+	}
+}
+
+// WithBufferSize sets the size in bytes of the copy buffers shared by
+// uploads and downloads, like buffer_size in the config file. The buffers
+// belong to the pools, so With ignores it.
+func WithBufferSize(size int) Option {
+	return func(c *config) {
+		c.bufferSize = size
+	}
+}
+
+// WithAllowEmptyFile lets zero-length files be uploaded, like
+// allow_empty_file in the config file.
+func WithAllowEmptyFile(allow bool) Option {
+	return func(c *config) {
+		c.allowEmptyFile = allow
+	}
+}
@@ -0,0 +1,789 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tedcy/fdfs_client/internal/testserver"
+)
+
+//a testserver.Server closed with the test
+func newTestServer(t *testing.T) *testserver.Server {
+	server, err := testserver.NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+//a client using server as its only tracker
+func newTestClient(t *testing.T, server *testserver.Server, opts ...Option) *Client {
+	opts = append([]Option{WithTrackers([]string{server.Addr()}), WithMaxConns(MAXCONNS_LEAST)}, opts...)
+	client, err := NewClientWithOptions(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Destroy)
+	return client
+}
+
+//an appender file uploaded with the first part and appended the others
+func uploadAppended(t *testing.T, client *Client, parts ...string) string {
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var fileId string
+	for i, part := range parts {
+		fileName := filepath.Join(dir, "part")
+		if err := ioutil.WriteFile(fileName, []byte(part), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			fileId, err = client.UploadAppenderByFilename(fileName)
+		} else {
+			err = client.AppendByFilename(fileId, fileName)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fileId
+}
+
+func TestTestServerRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+
+	fileId, err := client.UploadByBuffer([]byte("hello world"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := client.DownloadToBuffer(fileId, 0, 0)
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf("DownloadToBuffer = %q, %v", content, err)
+	}
+	head, err := client.DownloadHead(fileId, 5)
+	if err != nil || string(head) != "hello" {
+		t.Fatalf("DownloadHead = %q, %v", head, err)
+	}
+	if exists, err := client.FileExists(fileId); err != nil || !exists {
+		t.Fatalf("FileExists = %v, %v", exists, err)
+	}
+	if err := client.DeleteFile(fileId); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := client.FileExists(fileId); err != nil || exists {
+		t.Fatalf("FileExists after delete = %v, %v", exists, err)
+	}
+}
+
+//tells its size, but not how much of it was read already
+type sizeOnlyReader struct {
+	io.Reader
+	size int64
+}
+
+func (r sizeOnlyReader) Size() int64 {
+	return r.size
+}
+
+func TestUploadBySource(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	file, err := ioutil.TempFile("", "fdfs*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	reader := strings.NewReader("--hello")
+	reader.Seek(2, io.SeekStart)
+	section := io.NewSectionReader(strings.NewReader("--hello--"), 0, 7)
+	section.Read(make([]byte, 2))
+	for _, src := range []interface{}{file.Name(), []byte("hello"), reader, bytes.NewReader([]byte("hello")), section} {
+		fileId, err := client.Upload(src, "txt")
+		if err != nil {
+			t.Fatalf("Upload %T: %v", src, err)
+		}
+		if !strings.HasSuffix(fileId, ".txt") {
+			t.Fatalf("Upload %T stored %s", src, fileId)
+		}
+		if content, err := client.DownloadToBuffer(fileId, 0, 0); err != nil || string(content) != "hello" {
+			t.Fatalf("Upload %T = %q, %v", src, content, err)
+		}
+	}
+	for _, src := range []interface{}{io.MultiReader(), sizeOnlyReader{strings.NewReader("hello"), 5}, 42} {
+		if _, err := client.Upload(src, "txt"); err == nil {
+			t.Fatalf("Upload %T succeeded", src)
+		}
+	}
+}
+
+func TestCircuitBreakerDownload(t *testing.T) {
+	tracker := newTestServer(t)
+	storage := newTestServer(t)
+	tracker.SetStorage(storage.Addr())
+	client := newTestClient(t, tracker, WithCircuitBreaker(2, time.Minute, 50*time.Millisecond))
+	fileId, err := client.UploadByBuffer([]byte("hello"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := storage.Addr()
+
+	//down: the pooled conns break, then the dials are refused
+	storage.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := client.DownloadToBuffer(fileId, 0, 0); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("download %d from a closed storage = %v", i, err)
+		}
+	}
+	if !client.PoolStats()[addr].CircuitOpen {
+		t.Fatalf("closed after two failures, %+v", client.PoolStats()[addr])
+	}
+	requests := storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+	if _, err := client.DownloadToBuffer(fileId, 0, 0); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("DownloadToBuffer = %v, want ErrCircuitOpen", err)
+	}
+
+	//a failed trial after the cooldown opens it again at once
+	time.Sleep(60 * time.Millisecond)
+	if _, err := client.DownloadToBuffer(fileId, 0, 0); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("trial download = %v", err)
+	}
+	if !client.PoolStats()[addr].CircuitOpen {
+		t.Fatal("closed after a failed trial")
+	}
+
+	if err := storage.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if content, err := client.DownloadToBuffer(fileId, 0, 0); err != nil || string(content) != "hello" {
+		t.Fatalf("DownloadToBuffer after recovery = %q, %v", content, err)
+	}
+	if client.PoolStats()[addr].CircuitOpen {
+		t.Fatal("still open after a successful trial")
+	}
+	if storage.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE) != requests+1 {
+		t.Fatal("requests reached the storage while the circuit was open")
+	}
+}
+
+func TestCircuitBreakerFirstDial(t *testing.T) {
+	tracker := newTestServer(t)
+	//nothing listens there any more
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	tracker.SetStorage(addr)
+	client := newTestClient(t, tracker, WithCircuitBreaker(1, time.Minute, time.Minute))
+
+	if _, err := client.UploadByBuffer([]byte("hello"), "txt"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("upload to a dead storage = %v", err)
+	}
+	if stats := client.PoolStats()[addr]; !stats.CircuitOpen || stats.Open != 0 {
+		t.Fatalf("dead storage stats %+v", stats)
+	}
+	if _, err := client.UploadByBuffer([]byte("hello"), "txt"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("UploadByBuffer = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestUploadByFilenameExt(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	file, err := ioutil.TempFile("", "upload-*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	for _, test := range []struct {
+		fileExtName string
+		suffix      string
+	}{
+		{"jpg", ".jpg"},
+		{"longextension", ".longex"},
+		{"", ".tmp"},
+	} {
+		fileId, err := client.UploadByFilenameExt(file.Name(), test.fileExtName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(fileId, test.suffix) {
+			t.Fatalf("UploadByFilenameExt %q stored %s", test.fileExtName, fileId)
+		}
+	}
+}
+
+func TestSetTrackers(t *testing.T) {
+	servers := []*testserver.Server{newTestServer(t), newTestServer(t), newTestServer(t)}
+	client := newTestClient(t, servers[0])
+	kept := client.trackerPools.get()[0]
+
+	if err := client.SetTrackers([]string{servers[0].Addr(), "no port"}); err == nil {
+		t.Fatal("SetTrackers accepted an address without a port")
+	}
+	if err := client.SetTrackers([]string{servers[0].Addr(), servers[1].Addr(), servers[1].Addr()}); err != nil {
+		t.Fatal(err)
+	}
+	if pools := client.trackerPools.get(); len(pools) != 2 || pools[0] != kept {
+		t.Fatalf("trackers %v", client.PoolStats())
+	}
+
+	derived := client.With(WithNetworkTimeout(time.Second))
+	if err := client.SetTrackers([]string{servers[2].Addr()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := derived.PoolStats()[servers[2].Addr()]; !ok {
+		t.Fatal("derived client kept the old trackers")
+	}
+	if _, err := kept.get(); err == nil {
+		t.Fatal("removed tracker pool still hands out conns")
+	}
+	if err := derived.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadByFilenameToPath(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	file, err := ioutil.TempFile("", "fdfs*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	fileId, err := client.UploadByFilenameToPath(file.Name(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(fileId, "group1/M01/") {
+		t.Fatalf("stored %s, want store path 1", fileId)
+	}
+	if _, err := client.UploadByFilenameToPath(file.Name(), 2); err == nil || errors.As(err, new(*StatusError)) {
+		t.Fatalf("UploadByFilenameToPath past the path count = %v", err)
+	}
+}
+
+func TestUploadByFilenameToPathListGroups(t *testing.T) {
+	tracker := newTestServer(t)
+	down := newTestServer(t)
+	down.Close()
+	up := newTestServer(t)
+	tracker.SetStorage(down.Addr(), up.Addr())
+	client := newTestClient(t, tracker, WithMaxRetries(1))
+	file, err := ioutil.TempFile("", "fdfs*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	//retried on the other storage of the same group
+	if _, err := client.UploadByFilenameToPath(file.Name(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if lists := tracker.Requests(TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS); lists != 1 {
+		t.Fatalf("%d group lists for one upload", lists)
+	}
+
+	//the check is skipped when the tracker can't list the groups
+	tracker.Fail(TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS, 22)
+	if fileId, err := client.UploadByFilenameToPath(file.Name(), 1); err != nil || !strings.HasPrefix(fileId, "group1/M01/") {
+		t.Fatalf("UploadByFilenameToPath without the group list = %s, %v", fileId, err)
+	}
+}
+
+func TestClientWithRetries(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server, WithMaxRetries(2))
+	fileId, err := client.UploadByBuffer([]byte("hello"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := client.With(WithMaxRetries(0))
+
+	//each download asks the tracker first, so dropping the next one fails an attempt
+	server.Drop(1)
+	if _, err := strict.DownloadToBuffer(fileId, 0, 0); err == nil {
+		t.Fatal("derived client without retries survived a dropped conn")
+	}
+	server.Drop(1)
+	if content, err := client.DownloadToBuffer(fileId, 0, 0); err != nil || string(content) != "hello" {
+		t.Fatalf("parent client with retries = %q, %v", content, err)
+	}
+	if client.config.maxRetries != 2 {
+		t.Fatalf("With changed the parent's max retries to %d", client.config.maxRetries)
+	}
+}
+
+func TestUploadLargeFile(t *testing.T) {
+	content := make([]byte, 10*1024+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	file, err := ioutil.TempFile("", "fdfs*.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Write(content)
+	file.Close()
+
+	for _, test := range []struct {
+		chunkSize   int64
+		concurrency int
+		appends     int
+		modifies    int
+	}{
+		//smaller than a chunk, a normal upload
+		{int64(len(content)), 4, 0, 0},
+		//grown by one placeholder append, then 10 chunks modified in parallel
+		{1024, 4, 1, 10},
+		{1024, 1, 10, 0},
+	} {
+		server := newTestServer(t)
+		client := newTestClient(t, server)
+		fileId, err := client.UploadLargeFile(file.Name(), test.chunkSize, test.concurrency)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := server.File(fileId); !bytes.Equal(stored, content) {
+			t.Fatalf("chunk size %d concurrency %d stored %d bytes differing from the file", test.chunkSize, test.concurrency, len(stored))
+		}
+		appenders := server.Requests(STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE)
+		appends := server.Requests(STORAGE_PROTO_CMD_APPEND_FILE)
+		modifies := server.Requests(STORAGE_PROTO_CMD_MODIFY_FILE)
+		if (appenders == 1) != (test.chunkSize < int64(len(content))) || appends != test.appends || modifies != test.modifies {
+			t.Fatalf("chunk size %d concurrency %d: %d appender uploads, %d appends, %d modifies",
+				test.chunkSize, test.concurrency, appenders, appends, modifies)
+		}
+	}
+}
+
+func TestUploadStorePathIndex(t *testing.T) {
+	for _, test := range []struct {
+		ttl  time.Duration
+		want []byte
+	}{
+		//the index the tracker rotates per query
+		{0, []byte{0, 1, 0}},
+		//fresh from the tracker first, then the storage's own choice
+		{time.Minute, []byte{0, 0xFF, 0xFF}},
+	} {
+		server := newTestServer(t)
+		client := newTestClient(t, server, WithStoreCacheTTL(test.ttl))
+		for i := 0; i < 3; i++ {
+			if _, err := client.UploadByBuffer([]byte("hello"), "txt"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := server.PathIndexes(); !bytes.Equal(got, test.want) {
+			t.Fatalf("ttl %v store path indexes %v, want %v", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	fileId, err := client.UploadByBuffer([]byte("hello world"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "file")
+
+	for _, test := range []struct {
+		local     string
+		ok        bool
+		downloads int
+	}{
+		//only " world" is fetched
+		{"hello", true, 1},
+		{"hello world", true, 0},
+		{"", true, 1},
+		//the crc32 of the whole catches a changed prefix
+		{"HELLO", false, 1},
+		//longer than the file, nothing to fetch and the size is off
+		{"hello world!", false, 0},
+	} {
+		if err := ioutil.WriteFile(localFilename, []byte(test.local), 0644); err != nil {
+			t.Fatal(err)
+		}
+		downloads := server.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+		err := client.DownloadResume(fileId, localFilename)
+		if got := server.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE) - downloads; got != test.downloads {
+			t.Fatalf("resume from %q made %d downloads, want %d", test.local, got, test.downloads)
+		}
+		content, readErr := ioutil.ReadFile(localFilename)
+		if test.ok {
+			if err != nil || string(content) != "hello world" {
+				t.Fatalf("resume from %q = %q, %v", test.local, content, err)
+			}
+		} else if err == nil || !os.IsNotExist(readErr) {
+			t.Fatalf("resume from %q = %v, local file left %q", test.local, err, content)
+		}
+	}
+}
+
+func TestDownloadResumeAppender(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	//the size in the name is that of "hello", the storage is asked instead
+	fileId := uploadAppended(t, client, "hello", " world")
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "file")
+
+	for _, test := range []struct {
+		local     string
+		ok        bool
+		downloads int
+	}{
+		{"hello", true, 1},
+		{"hello world", true, 0},
+		{"", true, 1},
+		{"hello world!", false, 0},
+	} {
+		if err := ioutil.WriteFile(localFilename, []byte(test.local), 0644); err != nil {
+			t.Fatal(err)
+		}
+		downloads := server.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE)
+		err := client.DownloadResume(fileId, localFilename)
+		if got := server.Requests(STORAGE_PROTO_CMD_DOWNLOAD_FILE) - downloads; got != test.downloads {
+			t.Fatalf("resume from %q made %d downloads, want %d", test.local, got, test.downloads)
+		}
+		content, readErr := ioutil.ReadFile(localFilename)
+		if test.ok {
+			if err != nil || string(content) != "hello world" {
+				t.Fatalf("resume from %q = %q, %v", test.local, content, err)
+			}
+		} else if err == nil || !os.IsNotExist(readErr) {
+			t.Fatalf("resume from %q = %v, local file left %q", test.local, err, content)
+		}
+	}
+}
+
+func TestUploadRetryAnotherStorage(t *testing.T) {
+	tracker := newTestServer(t)
+	down := newTestServer(t)
+	down.Close()
+	up := newTestServer(t)
+	//the tracker hands out the storage that is down first
+	tracker.SetStorage(down.Addr(), up.Addr())
+	client := newTestClient(t, tracker, WithMaxRetries(1))
+
+	fileId, err := client.UploadByBuffer([]byte("hello"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, ok := up.File(fileId); !ok || string(content) != "hello" {
+		t.Fatalf("retry didn't store %s on the other storage", fileId)
+	}
+	if queries := tracker.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE); queries != 2 {
+		t.Fatalf("%d store queries, want a fresh one for the retry", queries)
+	}
+}
+
+func TestUploadStatusNotRetried(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server, WithMaxRetries(3))
+	server.Fail(STORAGE_PROTO_CMD_UPLOAD_FILE, statusENOSPC)
+
+	_, err := client.UploadByBuffer([]byte("hello"), "txt")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != statusENOSPC {
+		t.Fatalf("UploadByBuffer = %v, want the ENOSPC status", err)
+	}
+	if uploads := server.Requests(STORAGE_PROTO_CMD_UPLOAD_FILE); uploads != 1 {
+		t.Fatalf("a refused upload was sent %d times", uploads)
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	for _, maxRetries := range []int{0, 2} {
+		server := newTestServer(t)
+		client := newTestClient(t, server, WithMaxRetries(maxRetries))
+		//every attempt asks the tracker first, and is hung up on
+		server.Drop(10)
+		if _, err := client.UploadByBuffer([]byte("hello"), "txt"); err == nil {
+			t.Fatal("upload succeeded with every request dropped")
+		}
+		if queries := server.Requests(TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE); queries != maxRetries+1 {
+			t.Fatalf("max retries %d: %d attempts", maxRetries, queries)
+		}
+	}
+}
+
+func TestRetryInterval(t *testing.T) {
+	for _, test := range []struct {
+		backoff bool
+		least   time.Duration
+	}{
+		{false, 2 * 20 * time.Millisecond},
+		//20ms, then 40ms
+		{true, 3 * 20 * time.Millisecond},
+	} {
+		server := newTestServer(t)
+		client := newTestClient(t, server, WithMaxRetries(2), WithRetryInterval(20*time.Millisecond), WithRetryBackoff(test.backoff))
+		server.Drop(2)
+		start := time.Now()
+		if _, err := client.UploadByBuffer([]byte("hello"), "txt"); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < test.least {
+			t.Fatalf("backoff %v: two retries took %v, want at least %v", test.backoff, elapsed, test.least)
+		}
+	}
+}
+
+func TestUploadByFilenameWithMeta(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	file, err := ioutil.TempFile("", "fdfs*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	meta := map[string]string{"author": "tedcy"}
+	fileId, err := client.UploadByFilenameWithMeta(file.Name(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//set by the time it returns
+	if got, err := client.GetMetadata(fileId); err != nil || got["author"] != "tedcy" {
+		t.Fatalf("GetMetadata = %v, %v", got, err)
+	}
+
+	server.Fail(STORAGE_PROTO_CMD_SET_METADATA, 22)
+	if _, err := client.UploadByFilenameWithMeta(file.Name(), meta); err == nil {
+		t.Fatal("upload succeeded with the metadata refused")
+	}
+	if files := server.Files(); files != 1 {
+		t.Fatalf("%d files stored, the upload without metadata should be deleted", files)
+	}
+}
+
+func TestOpenCloseEarly(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	fileId, err := client.UploadByBuffer(content, "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := server.Addr()
+
+	for i := 0; i < 2*MAXCONNS_LEAST; i++ {
+		reader, err := client.Open(fileId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		head := make([]byte, 10)
+		if _, err := io.ReadFull(reader, head); err != nil || string(head) != "0123456789" {
+			t.Fatalf("read %q, %v", head, err)
+		}
+		open := client.PoolStats()[addr].Open
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+		//the rest of the body is still on the conn, it can't be pooled
+		if stats := client.PoolStats()[addr]; stats.Open != open-1 {
+			t.Fatalf("partly read conn kept, %+v", stats)
+		}
+		//the next operation on the pool isn't fed the rest of that body
+		if got, err := client.DownloadToBuffer(fileId, 0, 10); err != nil || string(got) != "0123456789" {
+			t.Fatalf("DownloadToBuffer after an early Close = %q, %v", got, err)
+		}
+	}
+}
+
+func TestDownloadToFileVerified(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	normal, err := client.UploadByBuffer([]byte("hello world"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the size and crc32 in the name are those of "hello"
+	appender := uploadAppended(t, client, "hello", " world")
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "file")
+
+	for _, test := range []struct {
+		fileId  string
+		queries int
+	}{
+		{normal, 0},
+		{appender, 1},
+	} {
+		queries := server.Requests(STORAGE_PROTO_CMD_QUERY_FILE_INFO)
+		if err := client.DownloadToFileVerified(test.fileId, localFilename); err != nil {
+			t.Fatalf("DownloadToFileVerified(%s) = %v", test.fileId, err)
+		}
+		if content, _ := ioutil.ReadFile(localFilename); string(content) != "hello world" {
+			t.Fatalf("DownloadToFileVerified(%s) wrote %q", test.fileId, content)
+		}
+		if got := server.Requests(STORAGE_PROTO_CMD_QUERY_FILE_INFO) - queries; got != test.queries {
+			t.Fatalf("DownloadToFileVerified(%s) made %d file info queries, want %d", test.fileId, got, test.queries)
+		}
+	}
+}
+
+func TestDownloadHead(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	normal, err := client.UploadByBuffer([]byte("hello world"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the size in the name is that of "hello"
+	appender := uploadAppended(t, client, "hello", " world")
+
+	for _, fileId := range []string{normal, appender} {
+		for _, test := range []struct {
+			n    int64
+			want string
+		}{
+			{8, "hello wo"},
+			//past the end of file, clamped to the size
+			{100, "hello world"},
+		} {
+			if head, err := client.DownloadHead(fileId, test.n); err != nil || string(head) != test.want {
+				t.Fatalf("DownloadHead(%s, %d) = %q, %v", fileId, test.n, head, err)
+			}
+		}
+	}
+}
+
+func TestUploadByBufferWithCrc32(t *testing.T) {
+	server := newTestServer(t)
+	client := newTestClient(t, server)
+	content := []byte("hello world")
+
+	fileId, err := client.UploadByBufferWithCrc32(content, "txt", crc32.ChecksumIEEE(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := server.File(fileId); !bytes.Equal(stored, content) {
+		t.Fatalf("stored %q", stored)
+	}
+	//checked against the name, the storage isn't asked
+	if queries := server.Requests(STORAGE_PROTO_CMD_QUERY_FILE_INFO); queries != 0 {
+		t.Fatalf("%d file info queries", queries)
+	}
+
+	if _, err := client.UploadByBufferWithCrc32(content, "txt", crc32.ChecksumIEEE(content)+1); err == nil {
+		t.Fatal("crc32 mismatch not reported")
+	}
+	if files := server.Files(); files != 1 {
+		t.Fatalf("%d files stored, the mismatched upload should be deleted", files)
+	}
+}
+
+func TestNewClientWithOptionsDefaults(t *testing.T) {
+	server := newTestServer(t)
+	client, err := NewClientWithOptions(WithTrackers([]string{server.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+	if _, err := client.UploadByBuffer([]byte("hello world"), "txt"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := client.PoolStats()[server.Addr()]; stats.MaxConns != DEFAULT_MAX_CONNS {
+		t.Fatalf("storage pool %+v", stats)
+	}
+}
+
+func TestTestOnBorrow(t *testing.T) {
+	for _, test := range []bool{false, true} {
+		server := newTestServer(t)
+		client := newTestClient(t, server, WithTestOnBorrow(test))
+		fileId, err := client.UploadByBuffer([]byte("hello world"), "txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.DownloadToBuffer(fileId, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		//the tracker and storage conns of the upload and the download
+		if tests := server.Requests(FDFS_PROTO_CMD_ACTIVE_TEST); (tests >= 4) != test {
+			t.Fatalf("test on borrow %v sent %d active tests", test, tests)
+		}
+	}
+}
+
+func TestWithConnFactory(t *testing.T) {
+	server := newTestServer(t)
+	server.SetStorage("storage:23000")
+	var lock sync.Mutex
+	made := make(map[string]int)
+	//in-process conns to the made up addrs, nothing is dialed
+	factory := func(addr string) (net.Conn, error) {
+		lock.Lock()
+		made[addr]++
+		lock.Unlock()
+		client, conn := net.Pipe()
+		go server.ServeConn(conn)
+		return client, nil
+	}
+	client, err := NewClientWithOptions(WithTrackers([]string{"tracker:22122"}), WithConnFactory(factory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	fileId, err := client.UploadByBuffer([]byte("hello world"), "txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := client.DownloadToBuffer(fileId, 0, 0); err != nil || string(content) != "hello world" {
+		t.Fatalf("DownloadToBuffer = %q, %v", content, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if made["tracker:22122"] == 0 || made["storage:23000"] == 0 {
+		t.Fatalf("factory made %v", made)
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 )
 
 type storageUploadTask struct {
@@ -14,12 +19,20 @@ type storageUploadTask struct {
 	//req
 	fileInfo         *fileInfo
 	storagePathIndex int8
+	//storagePathIndex set by the caller, not from the tracker
+	pinnedPathIndex bool
+	appender        bool
 	//res
-	fileId string
+	groupName      string
+	remoteFilename string
+	fileId         string
 }
 
 func (this *storageUploadTask) SendReq(conn net.Conn) error {
 	this.cmd = STORAGE_PROTO_CMD_UPLOAD_FILE
+	if this.appender {
+		this.cmd = STORAGE_PROTO_CMD_UPLOAD_APPENDER_FILE
+	}
 	this.pkgLen = this.fileInfo.fileSize + 15
 
 	if err := this.SendHeader(conn); err != nil {
@@ -42,18 +55,8 @@ func (this *storageUploadTask) SendReq(conn net.Conn) error {
 		return err
 	}
 
-	var err error
 	//send file
-	if this.fileInfo.file != nil {
-		_, err = conn.(pConn).Conn.(*net.TCPConn).ReadFrom(this.fileInfo.file)
-	} else {
-		_, err = conn.Write(this.fileInfo.buffer)
-	}
-
-	if err != nil {
-		return err
-	}
-	return nil
+	return sendFileInfo(conn, this.fileInfo)
 }
 
 func (this *storageUploadTask) RecvRes(conn net.Conn) error {
@@ -69,7 +72,7 @@ func (this *storageUploadTask) RecvRes(conn net.Conn) error {
 	}
 
 	buf := make([]byte, this.pkgLen)
-	if _, err := conn.Read(buf); err != nil {
+	if err := recvBody(conn, buf); err != nil {
 		return err
 	}
 
@@ -78,15 +81,311 @@ func (this *storageUploadTask) RecvRes(conn net.Conn) error {
 	if err != nil {
 		return err
 	}
-	remoteFileName, err := readCStrFromByteBuffer(buffer, int(this.pkgLen)-16)
+	remoteFileName, err := readCStrFromByteBuffer(buffer, int(this.pkgLen-16))
 	if err != nil {
 		return err
 	}
 
+	this.groupName = groupName
+	this.remoteFilename = remoteFileName
 	this.fileId = groupName + "/" + remoteFileName
 	return nil
 }
 
+type storageUploadSlaveTask struct {
+	storageUploadTask
+	//req
+	masterFilename string
+	prefixName     string
+}
+
+func (this *storageUploadSlaveTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_UPLOAD_SLAVE_FILE
+	this.pkgLen = int64(len(this.masterFilename)) + 38 + this.fileInfo.fileSize
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.masterFilename))); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, this.fileInfo.fileSize); err != nil {
+		return err
+	}
+	var bufferPrefixName [16]byte
+	copy(bufferPrefixName[:], this.prefixName)
+	buffer.Write(bufferPrefixName[:])
+	var bufferFileExtName [6]byte
+	copy(bufferFileExtName[:], this.fileInfo.fileExtName)
+	buffer.Write(bufferFileExtName[:])
+	buffer.WriteString(this.masterFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	//send file
+	return sendFileInfo(conn, this.fileInfo)
+}
+
+//answered like an upload, with the new fileId
+type storageRegenerateAppenderTask struct {
+	storageUploadTask
+	//req
+	appenderFilename string
+}
+
+func (this *storageRegenerateAppenderTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_REGENERATE_APPENDER_FILENAME
+	this.pkgLen = int64(len(this.appenderFilename))
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(this.appenderFilename)); err != nil {
+		return err
+	}
+	return nil
+}
+
+type storageAppendTask struct {
+	header
+	//req
+	fileInfo       *fileInfo
+	remoteFilename string
+}
+
+func (this *storageAppendTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_APPEND_FILE
+	this.pkgLen = int64(len(this.remoteFilename)) + 16 + this.fileInfo.fileSize
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename))); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, this.fileInfo.fileSize); err != nil {
+		return err
+	}
+	buffer.WriteString(this.remoteFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	//send file
+	return sendFileInfo(conn, this.fileInfo)
+}
+
+func (this *storageAppendTask) RecvRes(conn net.Conn) error {
+	return this.RecvHeader(conn)
+}
+
+type storageModifyTask struct {
+	header
+	//req
+	fileInfo       *fileInfo
+	remoteFilename string
+	fileOffset     int64
+}
+
+func (this *storageModifyTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_MODIFY_FILE
+	this.pkgLen = int64(len(this.remoteFilename)) + 24 + this.fileInfo.fileSize
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename))); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, this.fileOffset); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, this.fileInfo.fileSize); err != nil {
+		return err
+	}
+	buffer.WriteString(this.remoteFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	//send file
+	return sendFileInfo(conn, this.fileInfo)
+}
+
+func (this *storageModifyTask) RecvRes(conn net.Conn) error {
+	return this.RecvHeader(conn)
+}
+
+type storageTruncateTask struct {
+	header
+	//req
+	remoteFilename string
+	truncatedSize  int64
+}
+
+func (this *storageTruncateTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_TRUNCATE_FILE
+	this.pkgLen = int64(len(this.remoteFilename)) + 16
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename))); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, this.truncatedSize); err != nil {
+		return err
+	}
+	buffer.WriteString(this.remoteFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *storageTruncateTask) RecvRes(conn net.Conn) error {
+	return this.RecvHeader(conn)
+}
+
+type storageQueryFileInfoTask struct {
+	header
+	//req
+	groupName      string
+	remoteFilename string
+	//res
+	fileDetail FileDetail
+}
+
+func (this *storageQueryFileInfoTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_QUERY_FILE_INFO
+	this.pkgLen = int64(len(this.remoteFilename) + 16)
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	bufferGroupName := packGroupName(this.groupName)
+	buffer.Write(bufferGroupName[:])
+	buffer.WriteString(this.remoteFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *storageQueryFileInfoTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return err
+	}
+	if this.pkgLen != 24+IP_ADDRESS_SIZE {
+		return fmt.Errorf("recv file info pkgLen %d invaild", this.pkgLen)
+	}
+	buf := make([]byte, this.pkgLen)
+	if err := recvBody(conn, buf); err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(buf)
+	var crc32 int64
+	if err := binary.Read(buffer, binary.BigEndian, &this.fileDetail.FileSize); err != nil {
+		return err
+	}
+	if err := binary.Read(buffer, binary.BigEndian, &this.fileDetail.CreateTimestamp); err != nil {
+		return err
+	}
+	if err := binary.Read(buffer, binary.BigEndian, &crc32); err != nil {
+		return err
+	}
+	this.fileDetail.Crc32 = uint32(crc32)
+	var err error
+	this.fileDetail.SourceIpAddr, err = readCStrFromByteBuffer(buffer, IP_ADDRESS_SIZE)
+	return err
+}
+
+type storageSetMetadataTask struct {
+	header
+	//req
+	groupName      string
+	remoteFilename string
+	metaBuffer     []byte
+	flag           byte
+}
+
+func (this *storageSetMetadataTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_SET_METADATA
+	this.pkgLen = int64(len(this.remoteFilename)+len(this.metaBuffer)) + 33
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.remoteFilename))); err != nil {
+		return err
+	}
+	if err := binary.Write(buffer, binary.BigEndian, int64(len(this.metaBuffer))); err != nil {
+		return err
+	}
+	buffer.WriteByte(this.flag)
+	bufferGroupName := packGroupName(this.groupName)
+	buffer.Write(bufferGroupName[:])
+	buffer.WriteString(this.remoteFilename)
+	buffer.Write(this.metaBuffer)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *storageSetMetadataTask) RecvRes(conn net.Conn) error {
+	return this.RecvHeader(conn)
+}
+
+type storageGetMetadataTask struct {
+	header
+	//req
+	groupName      string
+	remoteFilename string
+	//res
+	meta map[string]string
+}
+
+func (this *storageGetMetadataTask) SendReq(conn net.Conn) error {
+	this.cmd = STORAGE_PROTO_CMD_GET_METADATA
+	this.pkgLen = int64(len(this.remoteFilename) + 16)
+
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	bufferGroupName := packGroupName(this.groupName)
+	buffer.Write(bufferGroupName[:])
+	buffer.WriteString(this.remoteFilename)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *storageGetMetadataTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return err
+	}
+	if this.pkgLen < 0 {
+		return fmt.Errorf("recv metadata pkgLen %d invaild", this.pkgLen)
+	}
+	buf := make([]byte, this.pkgLen)
+	if err := recvBody(conn, buf); err != nil {
+		return err
+	}
+	this.meta = unpackMetadata(buf)
+	return nil
+}
+
 type storageDownloadTask struct {
 	header
 	//req
@@ -96,7 +395,15 @@ type storageDownloadTask struct {
 	downloadBytes  int64
 	//res
 	localFilename string
+	dirPerm       os.FileMode
+	inPlace       bool
+	overwrite     OverwritePolicy
+	expectedCrc32 uint32
 	buffer        []byte
+	writer        io.Writer
+	progress      func(received, total int64)
+	crc32         hash.Hash32
+	recvBytes     int64
 }
 
 func (this *storageDownloadTask) SendReq(conn net.Conn) error {
@@ -113,11 +420,7 @@ func (this *storageDownloadTask) SendReq(conn net.Conn) error {
 	if err := binary.Write(buffer, binary.BigEndian, this.downloadBytes); err != nil {
 		return err
 	}
-	byteGroupName := []byte(this.groupName)
-	var bufferGroupName [16]byte
-	for i := 0; i < len(byteGroupName); i++ {
-		bufferGroupName[i] = byteGroupName[i]
-	}
+	bufferGroupName := packGroupName(this.groupName)
 	buffer.Write(bufferGroupName[:])
 	buffer.WriteString(this.remoteFilename)
 	if _, err := conn.Write(buffer.Bytes()); err != nil {
@@ -129,36 +432,100 @@ func (this *storageDownloadTask) SendReq(conn net.Conn) error {
 
 func (this *storageDownloadTask) RecvRes(conn net.Conn) error {
 	if err := this.RecvHeader(conn); err != nil {
-		return fmt.Errorf("StorageDownloadTask RecvRes %v", err)
+		return fmt.Errorf("StorageDownloadTask RecvRes %w", err)
 	}
 	if this.localFilename != "" {
 		if err := this.recvFile(conn); err != nil {
-			return fmt.Errorf("StorageDownloadTask RecvRes %v", err)
+			return fmt.Errorf("StorageDownloadTask RecvRes %w", err)
+		}
+	} else if this.writer != nil {
+		if err := this.recvWriter(conn, this.writer); err != nil {
+			return fmt.Errorf("StorageDownloadTask RecvRes %w", err)
 		}
 	} else {
 		if err := this.recvBuffer(conn); err != nil {
-			return fmt.Errorf("StorageDownloadTask RecvRes %v", err)
+			return fmt.Errorf("StorageDownloadTask RecvRes %w", err)
 		}
 	}
 	return nil
 }
 
+//unless inPlace, the content goes to a temp file next to localFilename that
+//is renamed over it once complete, so a failed download leaves no partial file
 func (this *storageDownloadTask) recvFile(conn net.Conn) error {
-	file, err := os.Create(this.localFilename)
-	defer file.Close()
+	if this.dirPerm != 0 {
+		if err := os.MkdirAll(filepath.Dir(this.localFilename), this.dirPerm); err != nil {
+			return err
+		}
+	}
+	if this.inPlace {
+		flag := os.O_TRUNC
+		if this.overwrite != OverwriteFile {
+			flag = os.O_EXCL
+		}
+		return this.recvToFile(conn, this.localFilename, flag)
+	}
+	tempFilename := fmt.Sprintf("%s.%s.tmp", this.localFilename, strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := this.recvToFile(conn, tempFilename, os.O_EXCL); err != nil {
+		return err
+	}
+	if this.overwrite != OverwriteFile {
+		//rename replaces silently, check for a file created meanwhile
+		if _, err := os.Lstat(this.localFilename); err == nil {
+			os.Remove(tempFilename)
+			return fmt.Errorf("%s %w", this.localFilename, ErrFileExists)
+		}
+	}
+	if err := os.Rename(tempFilename, this.localFilename); err != nil {
+		os.Remove(tempFilename)
+		return err
+	}
+	return nil
+}
+
+//a file it fails to complete is removed, neither a temp nor the file itself
+//is left half written
+func (this *storageDownloadTask) recvToFile(conn net.Conn, fileName string, flag int) (err error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|flag, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s %w", fileName, ErrFileExists)
+	}
 	if err != nil {
 		return err
 	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(fileName)
+		}
+	}()
 
 	writer := bufio.NewWriter(file)
 
-	if err := writeFromConn(conn, writer, this.pkgLen); err != nil {
-		return fmt.Errorf("StorageDownloadTask RecvFile %s", err)
+	if err := this.recvWriter(conn, writer); err != nil {
+		return fmt.Errorf("StorageDownloadTask RecvFile %w", err)
 	}
 	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("StorageDownloadTask RecvFile %s", err)
+		return fmt.Errorf("StorageDownloadTask RecvFile %w", err)
 	}
-	return nil
+	if this.crc32 != nil && this.crc32.Sum32() != this.expectedCrc32 {
+		return fmt.Errorf("StorageDownloadTask RecvFile crc32 %08x != %08x", this.crc32.Sum32(), this.expectedCrc32)
+	}
+	return file.Close()
+}
+
+func (this *storageDownloadTask) recvWriter(conn net.Conn, writer io.Writer) error {
+	var err error
+	if this.crc32 != nil {
+		//a retried download starts over
+		this.crc32.Reset()
+		writer = io.MultiWriter(writer, this.crc32)
+	}
+	if this.progress != nil {
+		writer = &progressWriter{writer: writer, total: this.pkgLen, progress: this.progress}
+	}
+	this.recvBytes, err = writeFromConn(conn, writer, this.pkgLen)
+	return err
 }
 
 func (this *storageDownloadTask) recvBuffer(conn net.Conn) error {
@@ -171,19 +538,71 @@ func (this *storageDownloadTask) recvBuffer(conn net.Conn) error {
 			return fmt.Errorf("StorageDownloadTask buffer < pkgLen can't recv")
         }
 		if err = writeFromConnToBuffer(conn, this.buffer, this.pkgLen); err != nil {
-			return fmt.Errorf("StorageDownloadTask writeFromConnToBuffer %s", err)
+			return fmt.Errorf("StorageDownloadTask writeFromConnToBuffer %w", err)
         }
+		this.recvBytes = this.pkgLen
 		return nil
     }
 	writer := new(bytes.Buffer)
 
-	if err = writeFromConn(conn, writer, this.pkgLen); err != nil {
-		return fmt.Errorf("StorageDownloadTask RecvBuffer %s", err)
+	if err = this.recvWriter(conn, writer); err != nil {
+		return fmt.Errorf("StorageDownloadTask RecvBuffer %w", err)
 	}
 	this.buffer = writer.Bytes()
 	return nil
 }
 
+type fileReader struct {
+	conn      net.Conn
+	remaining int64
+	timeout   time.Duration
+	err       error
+}
+
+func (this *fileReader) Read(p []byte) (int, error) {
+	if this.conn == nil {
+		return 0, fmt.Errorf("fileReader closed")
+	}
+	if this.err != nil {
+		return 0, this.err
+	}
+	if this.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	if this.timeout > 0 {
+		this.conn.SetDeadline(time.Now().Add(this.timeout))
+	}
+	n, err := this.conn.Read(p)
+	this.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	this.err = err
+	return n, err
+}
+
+func (this *fileReader) Close() error {
+	if this.conn == nil {
+		return nil
+	}
+	conn := this.conn
+	this.conn = nil
+	if this.remaining > 0 || this.err != nil {
+		//the rest of the body is still on the wire
+		if pConn, ok := conn.(pConn); ok {
+			return pConn.discard()
+		}
+		return conn.Close()
+	}
+	if this.timeout > 0 {
+		conn.SetDeadline(time.Time{})
+	}
+	return conn.Close()
+}
+
 type storageDeleteTask struct {
 	header
 	//req
@@ -199,11 +618,7 @@ func (this *storageDeleteTask) SendReq(conn net.Conn) error {
 		return err
 	}
 	buffer := new(bytes.Buffer)
-	byteGroupName := []byte(this.groupName)
-	var bufferGroupName [16]byte
-	for i := 0; i < len(byteGroupName); i++ {
-		bufferGroupName[i] = byteGroupName[i]
-	}
+	bufferGroupName := packGroupName(this.groupName)
 	buffer.Write(bufferGroupName[:])
 	buffer.WriteString(this.remoteFilename)
 	if _, err := conn.Write(buffer.Bytes()); err != nil {
@@ -215,3 +630,34 @@ func (this *storageDeleteTask) SendReq(conn net.Conn) error {
 func (this *storageDeleteTask) RecvRes(conn net.Conn) error {
 	return this.RecvHeader(conn)
 }
+
+func sendFileInfo(conn net.Conn, fileInfo *fileInfo) error {
+	var err error
+	if fileInfo.progress != nil {
+		var reader io.Reader = bytes.NewReader(fileInfo.buffer)
+		if fileInfo.file != nil {
+			reader = fileInfo.file
+		} else if fileInfo.reader != nil {
+			reader = fileInfo.reader
+		}
+		err = sendWithProgress(conn, reader, fileInfo.fileSize, fileInfo.progress)
+	} else if fileInfo.file != nil {
+		//limited so a file growing meanwhile doesn't overrun the announced size
+		if tcpConn, ok := tcpConnOf(conn); ok {
+			var sent int64
+			sent, err = tcpConn.ReadFrom(io.LimitReader(fileInfo.file, fileInfo.fileSize))
+			if err == nil && sent < fileInfo.fileSize {
+				//shrunk since the stat, the stream is short of the announced size
+				err = fmt.Errorf("file EOF after %d bytes, expect %d", sent, fileInfo.fileSize)
+			}
+		} else {
+			//no sendfile over TLS
+			err = sendFromReader(conn, fileInfo.file, fileInfo.fileSize)
+		}
+	} else if fileInfo.reader != nil {
+		err = sendFromReader(conn, fileInfo.reader, fileInfo.fileSize)
+	} else {
+		_, err = conn.Write(fileInfo.buffer)
+	}
+	return err
+}
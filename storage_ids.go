@@ -0,0 +1,63 @@
+package fdfs_client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//storage_ids.conf of a cluster with use_storage_id, one storage per line:
+//id, group name and ip or host, optionally with the port
+func parseStorageIds(r io.Reader) (map[string]string, error) {
+	storageIds := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("storage ids line %d: want id, group and address", lineNo)
+		}
+		if len(fields[0]) > FDFS_STORAGE_ID_MAX_SIZE {
+			return nil, fmt.Errorf("storage ids line %d: id %q longer than %d", lineNo, fields[0], FDFS_STORAGE_ID_MAX_SIZE)
+		}
+		storageIds[fields[0]] = fields[2]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return storageIds, nil
+}
+
+func loadStorageIds(fileName string) (map[string]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseStorageIds(f)
+}
+
+//the dial address of a storage the tracker answered with, an id mapped to
+//its address under use_storage_id. A mapped address without a port takes
+//the one from the tracker
+func (this *config) storageAddr(host string, port int64) string {
+	if this.useStorageId {
+		if addr, ok := this.storageIds[host]; ok {
+			if _, _, err := net.SplitHostPort(addr); err == nil {
+				return addr
+			}
+			host = addr
+		}
+	}
+	return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+}
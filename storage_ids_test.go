@@ -0,0 +1,46 @@
+package fdfs_client
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStorageIds(t *testing.T) {
+	conf := "# <id> <group_name> <ip_or_hostname[:port]>\n" +
+		"100001   group1  192.168.0.196\n" +
+		"\n" +
+		"100002\tgroup1\t192.168.0.197:23001 # second instance\n"
+	storageIds, err := parseStorageIds(strings.NewReader(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(storageIds) != 2 || storageIds["100001"] != "192.168.0.196" || storageIds["100002"] != "192.168.0.197:23001" {
+		t.Fatalf("storageIds = %v", storageIds)
+	}
+	if _, err := parseStorageIds(strings.NewReader("100001 group1\n")); err == nil {
+		t.Fatal("parsed a line without an address")
+	}
+}
+
+func TestStorageAddr(t *testing.T) {
+	config := &config{storageIds: map[string]string{
+		"100001": "192.168.0.196",
+		"100002": "192.168.0.197:23001",
+	}}
+	if addr := config.storageAddr("100001", 23000); addr != "100001:23000" {
+		t.Fatalf("without use_storage_id addr = %s", addr)
+	}
+	config.useStorageId = true
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{"100001", "192.168.0.196:23000"},
+		{"100002", "192.168.0.197:23001"},
+		{"10.0.0.1", "10.0.0.1:23000"},
+	} {
+		if addr := config.storageAddr(tc.host, 23000); addr != tc.want {
+			t.Errorf("storageAddr(%s) = %s, want %s", tc.host, addr, tc.want)
+		}
+	}
+}
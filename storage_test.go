@@ -0,0 +1,405 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//recordConn keeps everything written to it
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestUploadHeaderLargeFile(t *testing.T) {
+	const size = int64(3) << 30
+	task := &storageUploadTask{}
+	//an empty reader stops the upload right after the header and body prefix
+	task.fileInfo = &fileInfo{
+		fileSize:    size,
+		reader:      strings.NewReader(""),
+		fileExtName: "mp4",
+	}
+	conn := &recordConn{}
+	if err := task.SendReq(conn); err == nil {
+		t.Fatal("SendReq succeeded without content")
+	}
+
+	buf := conn.written.Bytes()
+	if len(buf) != 25 {
+		t.Fatalf("wrote %d bytes, want 25", len(buf))
+	}
+	if pkgLen := int64(binary.BigEndian.Uint64(buf[:8])); pkgLen != size+15 {
+		t.Fatalf("pkgLen = %d, want %d", pkgLen, size+15)
+	}
+	if buf[8] != STORAGE_PROTO_CMD_UPLOAD_FILE {
+		t.Fatalf("cmd = %d", buf[8])
+	}
+	if fileSize := int64(binary.BigEndian.Uint64(buf[11:19])); fileSize != size {
+		t.Fatalf("fileSize = %d, want %d", fileSize, size)
+	}
+	if ext := string(bytes.TrimRight(buf[19:25], "\x00")); ext != "mp4" {
+		t.Fatalf("ext = %q", ext)
+	}
+}
+
+func TestUploadHeaderStorePathIndex(t *testing.T) {
+	for _, index := range []int8{0, 1, 3} {
+		task := &storageUploadTask{storagePathIndex: index}
+		task.fileInfo = &fileInfo{
+			fileSize:    5,
+			reader:      strings.NewReader("hello"),
+			fileExtName: "txt",
+		}
+		conn := &recordConn{}
+		if err := task.SendReq(conn); err != nil {
+			t.Fatal(err)
+		}
+		if got := int8(conn.written.Bytes()[headerSize]); got != index {
+			t.Fatalf("store path index byte %d, want %d", got, index)
+		}
+	}
+}
+
+func TestStatusErrorIs(t *testing.T) {
+	var err error = &StatusError{Cmd: TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, Status: 2}
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("%v is not ErrFileNotFound", err)
+	}
+	err = fmt.Errorf("download: %w", &StatusError{Cmd: TRACKER_PROTO_CMD_SERVICE_QUERY_STORE_WITHOUT_GROUP_ONE, Status: 28})
+	if !errors.Is(err, ErrNoAvailableStorage) || errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("%v should only be ErrNoAvailableStorage", err)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != 28 {
+		t.Fatalf("errors.As lost the status of %v", err)
+	}
+}
+
+func TestSendFileInfoProgress(t *testing.T) {
+	fileInfo := &fileInfo{
+		fileSize: 70 * 1024,
+		buffer:   make([]byte, 70*1024),
+	}
+	var reports []int64
+	fileInfo.progress = func(sent, total int64) {
+		if total != fileInfo.fileSize {
+			t.Fatalf("total = %d", total)
+		}
+		reports = append(reports, sent)
+	}
+	conn := &recordConn{}
+	if err := sendFileInfo(conn, fileInfo); err != nil {
+		t.Fatal(err)
+	}
+	if conn.written.Len() != 70*1024 {
+		t.Fatalf("wrote %d bytes", conn.written.Len())
+	}
+	if fmt.Sprint(reports) != "[32768 65536 71680]" {
+		t.Fatalf("reports = %v", reports)
+	}
+}
+
+func TestUploadEmptyFile(t *testing.T) {
+	task := &storageUploadTask{}
+	task.fileInfo = &fileInfo{fileExtName: "txt"}
+	conn := &recordConn{}
+	if err := task.SendReq(conn); err != nil {
+		t.Fatal(err)
+	}
+	buf := conn.written.Bytes()
+	if len(buf) != 25 {
+		t.Fatalf("wrote %d bytes, want header and body prefix only", len(buf))
+	}
+	if pkgLen := binary.BigEndian.Uint64(buf[:8]); pkgLen != 15 {
+		t.Fatalf("pkgLen = %d, want 15", pkgLen)
+	}
+}
+
+func TestFileReaderClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello world"))
+		}
+	}()
+	pool, err := newConnPool(listener.Addr().String(), &config{maxConns: MAXCONNS_LEAST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Destroy()
+
+	conn, err := pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := &fileReader{conn: conn, remaining: 5}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil || string(content) != "hello" {
+		t.Fatalf("ReadAll = %q, %v", content, err)
+	}
+	reader.Close()
+	if stats := pool.Stats(); stats.Idle != MAXCONNS_LEAST || stats.Open != MAXCONNS_LEAST {
+		t.Fatalf("fully read conn not put back, %+v", stats)
+	}
+
+	conn, err = pool.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = &fileReader{conn: conn, remaining: 11}
+	if _, err := reader.Read(make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if stats := pool.Stats(); stats.Open != MAXCONNS_LEAST-1 {
+		t.Fatalf("partly read conn not dropped, %+v", stats)
+	}
+	if _, err := reader.Read(make([]byte, 5)); err == nil {
+		t.Fatal("Read succeeded after Close")
+	}
+}
+
+func TestDownloadRecvFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "a", "b", "file")
+	response := func(body string, pkgLen int64) *replayConn {
+		buf := new(bytes.Buffer)
+		writeHeader(buf, pkgLen, TRACKER_PROTO_CMD_RESP, 0)
+		buf.WriteString(body)
+		return &replayConn{response: bytes.NewReader(buf.Bytes())}
+	}
+
+	task := &storageDownloadTask{localFilename: localFilename, dirPerm: DEFAULT_DOWNLOAD_DIR_PERM}
+	if err := task.RecvRes(response("hello", 5)); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(localFilename); err != nil || string(content) != "hello" {
+		t.Fatalf("ReadFile = %q, %v", content, err)
+	}
+
+	//a cut off body keeps the old content and leaves no temp file behind
+	task = &storageDownloadTask{localFilename: localFilename, dirPerm: DEFAULT_DOWNLOAD_DIR_PERM}
+	if err := task.RecvRes(response("wor", 5)); err == nil {
+		t.Fatal("RecvRes succeeded on a cut off body")
+	}
+	if content, err := ioutil.ReadFile(localFilename); err != nil || string(content) != "hello" {
+		t.Fatalf("ReadFile = %q, %v", content, err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "a", "b", "*")); len(names) != 1 {
+		t.Fatalf("files left %v", names)
+	}
+}
+
+func TestUploadMaxFileSize(t *testing.T) {
+	client := &Client{config: &config{maxFileSize: 4}}
+	if _, err := client.UploadByBuffer([]byte("hello"), "txt"); !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("UploadByBuffer = %v, want ErrFileTooLarge", err)
+	}
+	if err := client.checkFileInfo(&fileInfo{fileSize: 4}); err != nil {
+		t.Fatalf("checkFileInfo at the limit = %v", err)
+	}
+	client.config.maxFileSize = 0
+	if err := client.checkFileInfo(&fileInfo{fileSize: 1 << 40}); err != nil {
+		t.Fatalf("checkFileInfo unlimited = %v", err)
+	}
+}
+
+func TestDownloadRecvFileExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	localFilename := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(localFilename, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, inPlace := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		writeHeader(buf, 5, TRACKER_PROTO_CMD_RESP, 0)
+		buf.WriteString("hello")
+		task := &storageDownloadTask{localFilename: localFilename, inPlace: inPlace, overwrite: FailIfExists}
+		if err := task.RecvRes(&replayConn{response: bytes.NewReader(buf.Bytes())}); !errors.Is(err, ErrFileExists) {
+			t.Fatalf("inPlace %v RecvRes = %v, want ErrFileExists", inPlace, err)
+		}
+		if content, _ := ioutil.ReadFile(localFilename); string(content) != "old" {
+			t.Fatalf("inPlace %v overwrote with %q", inPlace, content)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		t.Fatalf("files left %v", names)
+	}
+}
+
+func TestCheckLocalFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello")
+	file.Close()
+
+	fileDetail := &FileDetail{FileSize: 5, Crc32: crc32.ChecksumIEEE([]byte("hello"))}
+	if err := checkLocalFile(file.Name(), fileDetail, true); err != nil {
+		t.Fatal(err)
+	}
+	fileDetail.Crc32++
+	if err := checkLocalFile(file.Name(), fileDetail, true); err == nil {
+		t.Fatal("crc32 mismatch passed")
+	}
+	if err := checkLocalFile(file.Name(), fileDetail, false); err != nil {
+		t.Fatalf("appender file check = %v", err)
+	}
+	fileDetail.FileSize = 6
+	if err := checkLocalFile(file.Name(), fileDetail, false); err == nil {
+		t.Fatal("size mismatch passed")
+	}
+}
+
+func TestDownloadShortRead(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	//announces 10 bytes and hangs up after 4
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			writeHeader(conn, 10, TRACKER_PROTO_CMD_RESP, 0)
+			conn.Write([]byte("hell"))
+			conn.Close()
+		}
+	}()
+	dir, err := ioutil.TempDir("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, task := range []*storageDownloadTask{
+		{},
+		{buffer: make([]byte, 10)},
+		{localFilename: filepath.Join(dir, "atomic")},
+		{localFilename: filepath.Join(dir, "inplace"), inPlace: true},
+	} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = task.RecvRes(conn)
+		conn.Close()
+		var shortRead *ShortReadError
+		if !errors.As(err, &shortRead) || shortRead.Expected != 10 || shortRead.Got != 4 {
+			t.Fatalf("RecvRes = %v, want a ShortReadError of 4 of 10 bytes", err)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 0 {
+		t.Fatalf("partial files left %v", names)
+	}
+}
+
+func TestUploadRecvResSplitBody(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	remoteFilename := "M00/00/00/wKgBCl9eEAAAAAAAAAAE0t6tvu8.txt"
+	go func() {
+		defer server.Close()
+		writeHeader(server, int64(FDFS_GROUP_NAME_MAX_LEN+len(remoteFilename)), TRACKER_PROTO_CMD_RESP, 0)
+		//the id comes in two reads
+		group := make([]byte, FDFS_GROUP_NAME_MAX_LEN)
+		copy(group, "group1")
+		server.Write(group)
+		server.Write([]byte(remoteFilename))
+	}()
+
+	task := &storageUploadTask{}
+	if err := task.RecvRes(client); err != nil {
+		t.Fatal(err)
+	}
+	if task.fileId != "group1/"+remoteFilename {
+		t.Fatalf("fileId %q", task.fileId)
+	}
+}
+
+func TestUploadRecvResShortRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		//announces a 60 byte id and hangs up after the group name
+		writeHeader(server, 60, TRACKER_PROTO_CMD_RESP, 0)
+		server.Write(make([]byte, FDFS_GROUP_NAME_MAX_LEN))
+	}()
+
+	task := &storageUploadTask{}
+	err := task.RecvRes(client)
+	var shortRead *ShortReadError
+	if !errors.As(err, &shortRead) || shortRead.Expected != 60 || shortRead.Got != FDFS_GROUP_NAME_MAX_LEN {
+		t.Fatalf("RecvRes = %v, want a ShortReadError of %d of 60 bytes", err, FDFS_GROUP_NAME_MAX_LEN)
+	}
+}
+
+func TestSendFileInfoShrunkFile(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}()
+	file, err := ioutil.TempFile("", "fdfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	file.WriteString("hello")
+	file.Seek(0, 0)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//stat said 10 bytes, only 5 are left
+	if err := sendFileInfo(conn, &fileInfo{fileSize: 10, file: file}); err == nil {
+		t.Fatal("sendFileInfo sent a shrunk file without an error")
+	}
+}
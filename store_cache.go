@@ -0,0 +1,79 @@
+package fdfs_client
+
+import (
+	"sync"
+	"time"
+)
+
+//a store path index that lets the storage choose, as it does by its own
+//store_path rule
+const storePathIndexAny = -1
+
+//storeCache remembers the storage the tracker picked for uploads to a group
+//for ttl, so a burst of uploads costs a single tracker query. The store path
+//index isn't kept: the tracker may rotate it per query, so cached uploads let
+//the storage pick the path instead of all landing on one
+type storeCache struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]storeCacheEntry
+}
+
+type storeCacheEntry struct {
+	groupName string
+	addr      string
+	expires   time.Time
+}
+
+func newStoreCache(ttl time.Duration) *storeCache {
+	return &storeCache{
+		ttl:     ttl,
+		entries: make(map[string]storeCacheEntry),
+	}
+}
+
+func (this *storeCache) get(groupName string) (*StorageInfo, bool) {
+	if this == nil || this.ttl <= 0 {
+		return nil, false
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	entry, ok := this.entries[groupName]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(this.entries, groupName)
+		return nil, false
+	}
+	return &StorageInfo{
+		GroupName:      entry.groupName,
+		Addr:           entry.addr,
+		StorePathIndex: storePathIndexAny,
+	}, true
+}
+
+func (this *storeCache) put(groupName string, storageInfo *StorageInfo) {
+	if this == nil || this.ttl <= 0 {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.entries[groupName] = storeCacheEntry{
+		groupName: storageInfo.GroupName,
+		addr:      storageInfo.Addr,
+		expires:   time.Now().Add(this.ttl),
+	}
+}
+
+//drop the entry only if it still points at addr, a newer pick stays
+func (this *storeCache) invalidate(groupName string, addr string) {
+	if this == nil || this.ttl <= 0 {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if entry, ok := this.entries[groupName]; ok && entry.addr == addr {
+		delete(this.entries, groupName)
+	}
+}
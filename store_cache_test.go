@@ -0,0 +1,36 @@
+package fdfs_client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreCache(t *testing.T) {
+	cache := newStoreCache(20 * time.Millisecond)
+	cache.put("group1", &StorageInfo{GroupName: "group1", Addr: "10.0.0.1:23000", StorePathIndex: 1})
+	if storageInfo, ok := cache.get("group1"); !ok || storageInfo.Addr != "10.0.0.1:23000" || storageInfo.StorePathIndex != storePathIndexAny {
+		t.Fatalf("get = %+v, %v", storageInfo, ok)
+	}
+	if _, ok := cache.get("group2"); ok {
+		t.Fatal("hit for an unknown group")
+	}
+
+	cache.invalidate("group1", "10.0.0.2:23000")
+	if _, ok := cache.get("group1"); !ok {
+		t.Fatal("invalidating another storage dropped the entry")
+	}
+	cache.invalidate("group1", "10.0.0.1:23000")
+	if _, ok := cache.get("group1"); ok {
+		t.Fatal("hit after invalidate")
+	}
+
+	cache.put("group1", &StorageInfo{GroupName: "group1", Addr: "10.0.0.1:23000"})
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := cache.get("group1"); ok {
+		t.Fatal("hit after ttl")
+	}
+
+	if _, ok := newStoreCache(0).get("group1"); ok {
+		t.Fatal("hit with the cache disabled")
+	}
+}
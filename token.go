@@ -0,0 +1,23 @@
+package fdfs_client
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+)
+
+// GenAntiStealToken computes the http.anti_steal token checked by the
+// fastdfs nginx module: the hex md5 of remoteFilename, secretKey and the
+// decimal timestamp, as fdfs_http_gen_token does. remoteFilename is without
+// the group, e.g. "M00/00/00/xxx.jpg".
+func GenAntiStealToken(remoteFilename string, timestamp int64, secretKey string) string {
+	sum := md5.Sum([]byte(remoteFilename + secretKey + strconv.FormatInt(timestamp, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// AntiStealQuery is the "token=...&ts=..." query string to append to the
+// file's URL.
+func AntiStealQuery(remoteFilename string, timestamp int64, secretKey string) string {
+	return "token=" + GenAntiStealToken(remoteFilename, timestamp, secretKey) +
+		"&ts=" + strconv.FormatInt(timestamp, 10)
+}
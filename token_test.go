@@ -0,0 +1,19 @@
+package fdfs_client
+
+import (
+	"testing"
+)
+
+func TestGenAntiStealToken(t *testing.T) {
+	const (
+		remoteFilename = "M00/00/00/wKgBaFq7p0SAQ3a9AAAABHdCqbE242.txt"
+		secretKey      = "FastDFS1234567890"
+		timestamp      = 1522247184
+	)
+	if token := GenAntiStealToken(remoteFilename, timestamp, secretKey); token != "dc1c81d4bc2afe14bb7d307781b21075" {
+		t.Fatalf("token = %s", token)
+	}
+	if query := AntiStealQuery(remoteFilename, timestamp, secretKey); query != "token=dc1c81d4bc2afe14bb7d307781b21075&ts=1522247184" {
+		t.Fatalf("query = %s", query)
+	}
+}
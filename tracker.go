@@ -7,6 +7,9 @@ import (
 	"net"
 )
 
+//group, ip and port of one storage, a store query adds the store path index
+const trackerStorageBodyLen = FDFS_GROUP_NAME_MAX_LEN + IP_ADDRESS_SIZE - 1 + 8
+
 type trackerStorageInfo struct {
 	groupName      string
 	ipAddr         string
@@ -32,11 +35,7 @@ func (this *trackerTask) SendReq(conn net.Conn) error {
 	}
 	if this.groupName != "" {
 		buffer := new(bytes.Buffer)
-		byteGroupName := []byte(this.groupName)
-		var bufferGroupName [16]byte
-		for i := 0; i < len(byteGroupName); i++ {
-			bufferGroupName[i] = byteGroupName[i]
-		}
+		bufferGroupName := packGroupName(this.groupName)
 		buffer.Write(bufferGroupName[:])
 		buffer.WriteString(this.remoteFilename)
 		if _, err := conn.Write(buffer.Bytes()); err != nil {
@@ -48,13 +47,16 @@ func (this *trackerTask) SendReq(conn net.Conn) error {
 
 func (this *trackerTask) RecvRes(conn net.Conn) error {
 	if err := this.RecvHeader(conn); err != nil {
-		return fmt.Errorf("TrackerTask RecvHeader %v", err)
+		return fmt.Errorf("TrackerTask RecvHeader %w", err)
 	}
-	if this.pkgLen != 39 && this.pkgLen != 40 {
+	if this.pkgLen < trackerStorageBodyLen {
+		return fmt.Errorf("recvStorageInfo pkgLen %d %w", this.pkgLen, ErrNoAvailableStorage)
+	}
+	if this.pkgLen != trackerStorageBodyLen && this.pkgLen != trackerStorageBodyLen+1 {
 		return fmt.Errorf("recvStorageInfo pkgLen %d invaild", this.pkgLen)
 	}
 	buf := make([]byte, this.pkgLen)
-	if _, err := conn.Read(buf); err != nil {
+	if err := recvBody(conn, buf); err != nil {
 		return err
 	}
 
@@ -68,6 +70,9 @@ func (this *trackerTask) RecvRes(conn net.Conn) error {
 	if err != nil {
 		return err
 	}
+	if this.ipAddr == "" {
+		return fmt.Errorf("recvStorageInfo empty ip %w", ErrNoAvailableStorage)
+	}
 	if err := binary.Read(buffer, binary.BigEndian, &this.port); err != nil {
 		return err
 	}
@@ -80,3 +85,339 @@ func (this *trackerTask) RecvRes(conn net.Conn) error {
 	}
 	return nil
 }
+
+//answer of QUERY_FETCH_ALL: the first storage in full, then the ip of every
+//other storage holding the file, all sharing the first one's port
+type trackerQueryAllTask struct {
+	trackerTask
+	//res
+	ipAddrs []string
+}
+
+func (this *trackerQueryAllTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return fmt.Errorf("TrackerTask RecvHeader %w", err)
+	}
+	if this.pkgLen < trackerStorageBodyLen {
+		return fmt.Errorf("recvStorageInfoList pkgLen %d %w", this.pkgLen, ErrNoAvailableStorage)
+	}
+	if (this.pkgLen-trackerStorageBodyLen)%(IP_ADDRESS_SIZE-1) != 0 {
+		return fmt.Errorf("recvStorageInfoList pkgLen %d invaild", this.pkgLen)
+	}
+	buf := make([]byte, this.pkgLen)
+	if err := recvBody(conn, buf); err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(buf)
+	var err error
+	this.groupName, err = readCStrFromByteBuffer(buffer, 16)
+	if err != nil {
+		return err
+	}
+	this.ipAddr, err = readCStrFromByteBuffer(buffer, 15)
+	if err != nil {
+		return err
+	}
+	if this.ipAddr == "" {
+		return fmt.Errorf("recvStorageInfo empty ip %w", ErrNoAvailableStorage)
+	}
+	if err := binary.Read(buffer, binary.BigEndian, &this.port); err != nil {
+		return err
+	}
+	this.ipAddrs = []string{this.ipAddr}
+	for buffer.Len() > 0 {
+		ipAddr, err := readCStrFromByteBuffer(buffer, IP_ADDRESS_SIZE-1)
+		if err != nil {
+			return err
+		}
+		this.ipAddrs = append(this.ipAddrs, ipAddr)
+	}
+	return nil
+}
+
+// GroupStat is a group as listed by the tracker, sizes in MB.
+type GroupStat struct {
+	GroupName          string
+	TotalMB            int64
+	FreeMB             int64
+	TrunkFreeMB        int64
+	StorageCount       int64
+	StoragePort        int64
+	StorageHttpPort    int64
+	ActiveCount        int64
+	CurrentWriteServer int64
+	StorePathCount     int64
+	SubdirCountPerPath int64
+	CurrentTrunkFileId int64
+}
+
+type trackerListGroupsTask struct {
+	header
+	//res
+	groupStats []GroupStat
+}
+
+func (this *trackerListGroupsTask) SendReq(conn net.Conn) error {
+	this.cmd = TRACKER_PROTO_CMD_SERVER_LIST_ALL_GROUPS
+	this.pkgLen = 0
+	return this.SendHeader(conn)
+}
+
+func (this *trackerListGroupsTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return fmt.Errorf("TrackerListGroupsTask RecvHeader %w", err)
+	}
+	if this.pkgLen%TRACKER_GROUP_STAT_SIZE != 0 {
+		return fmt.Errorf("recvGroupStat pkgLen %d invaild", this.pkgLen)
+	}
+	buf := make([]byte, this.pkgLen)
+	if err := recvBody(conn, buf); err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(buf)
+	this.groupStats = make([]GroupStat, 0, this.pkgLen/TRACKER_GROUP_STAT_SIZE)
+	for buffer.Len() > 0 {
+		var groupStat GroupStat
+		var err error
+		groupStat.GroupName, err = readCStrFromByteBuffer(buffer, FDFS_GROUP_NAME_MAX_LEN+1)
+		if err != nil {
+			return err
+		}
+		for _, field := range []*int64{
+			&groupStat.TotalMB,
+			&groupStat.FreeMB,
+			&groupStat.TrunkFreeMB,
+			&groupStat.StorageCount,
+			&groupStat.StoragePort,
+			&groupStat.StorageHttpPort,
+			&groupStat.ActiveCount,
+			&groupStat.CurrentWriteServer,
+			&groupStat.StorePathCount,
+			&groupStat.SubdirCountPerPath,
+			&groupStat.CurrentTrunkFileId,
+		} {
+			if err := binary.Read(buffer, binary.BigEndian, field); err != nil {
+				return err
+			}
+		}
+		this.groupStats = append(this.groupStats, groupStat)
+	}
+	return nil
+}
+
+// StorageStatus is the state of a storage server as the tracker sees it.
+type StorageStatus int8
+
+// The values of FDFS_STORAGE_STATUS_* in fastdfs tracker_types.h.
+const (
+	StorageStatusInit      StorageStatus = 0
+	StorageStatusWaitSync  StorageStatus = 1
+	StorageStatusSyncing   StorageStatus = 2
+	StorageStatusIpChanged StorageStatus = 3
+	StorageStatusDeleted   StorageStatus = 4
+	StorageStatusOffline   StorageStatus = 5
+	StorageStatusOnline    StorageStatus = 6
+	StorageStatusActive    StorageStatus = 7
+	StorageStatusRecovery  StorageStatus = 9
+	StorageStatusNone      StorageStatus = 99
+)
+
+var storageStatusNames = map[StorageStatus]string{
+	StorageStatusInit:      "INIT",
+	StorageStatusWaitSync:  "WAIT_SYNC",
+	StorageStatusSyncing:   "SYNCING",
+	StorageStatusIpChanged: "IP_CHANGED",
+	StorageStatusDeleted:   "DELETED",
+	StorageStatusOffline:   "OFFLINE",
+	StorageStatusOnline:    "ONLINE",
+	StorageStatusActive:    "ACTIVE",
+	StorageStatusRecovery:  "RECOVERY",
+	StorageStatusNone:      "NONE",
+}
+
+// String is the name fdfs_monitor prints, e.g. ACTIVE, or the number for a
+// status this client doesn't know.
+func (this StorageStatus) String() string {
+	if name, ok := storageStatusNames[this]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int8(this))
+}
+
+// StorageStat is a storage server as listed by the tracker, sizes in MB and
+// times in unix seconds.
+type StorageStat struct {
+	Status               StorageStatus
+	Id                   string
+	IpAddr               string
+	DomainName           string
+	SrcId                string
+	Version              string
+	JoinTime             int64
+	UpTime               int64
+	TotalMB              int64
+	FreeMB               int64
+	UploadPriority       int64
+	StorePathCount       int64
+	SubdirCountPerPath   int64
+	StoragePort          int64
+	StorageHttpPort      int64
+	CurrentWritePath     int64
+	TotalUploadCount     int64
+	SuccessUploadCount   int64
+	TotalDownloadCount   int64
+	SuccessDownloadCount int64
+	TotalUploadBytes     int64
+	SuccessUploadBytes   int64
+	TotalDownloadBytes   int64
+	SuccessDownloadBytes int64
+	LastHeartBeatTime    int64
+	IfTrunkServer        bool
+}
+
+type trackerListStoragesTask struct {
+	header
+	//req
+	groupName string
+	storageIP string
+	//res
+	storageStats []StorageStat
+}
+
+func (this *trackerListStoragesTask) SendReq(conn net.Conn) error {
+	this.cmd = TRACKER_PROTO_CMD_SERVER_LIST_STORAGE
+	this.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(this.storageIP))
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	bufferGroupName := packGroupName(this.groupName)
+	buffer.Write(bufferGroupName[:])
+	buffer.WriteString(this.storageIP)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *trackerListStoragesTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return fmt.Errorf("TrackerListStoragesTask RecvHeader %w", err)
+	}
+	if this.pkgLen%TRACKER_STORAGE_STAT_SIZE != 0 {
+		return fmt.Errorf("recvStorageStat pkgLen %d invaild", this.pkgLen)
+	}
+	buf := make([]byte, this.pkgLen)
+	if err := recvBody(conn, buf); err != nil {
+		return err
+	}
+
+	buffer := bytes.NewBuffer(buf)
+	this.storageStats = make([]StorageStat, 0, this.pkgLen/TRACKER_STORAGE_STAT_SIZE)
+	for buffer.Len() > 0 {
+		var storageStat StorageStat
+		var err error
+		status, _ := buffer.ReadByte()
+		storageStat.Status = StorageStatus(status)
+		for _, field := range []struct {
+			value *string
+			size  int
+		}{
+			{&storageStat.Id, FDFS_STORAGE_ID_MAX_SIZE},
+			{&storageStat.IpAddr, IP_ADDRESS_SIZE},
+			{&storageStat.DomainName, FDFS_DOMAIN_NAME_MAX_SIZE},
+			{&storageStat.SrcId, FDFS_STORAGE_ID_MAX_SIZE},
+			{&storageStat.Version, FDFS_VERSION_SIZE},
+		} {
+			if *field.value, err = readCStrFromByteBuffer(buffer, field.size); err != nil {
+				return err
+			}
+		}
+		var skip int64
+		for _, field := range []*int64{
+			&storageStat.JoinTime,
+			&storageStat.UpTime,
+			&storageStat.TotalMB,
+			&storageStat.FreeMB,
+			&storageStat.UploadPriority,
+			&storageStat.StorePathCount,
+			&storageStat.SubdirCountPerPath,
+			&storageStat.StoragePort,
+			&storageStat.StorageHttpPort,
+			&storageStat.CurrentWritePath,
+		} {
+			if err := binary.Read(buffer, binary.BigEndian, field); err != nil {
+				return err
+			}
+		}
+		//alloc, current and max connection counts, 4 bytes each
+		buffer.Next(12)
+		//the counters in their protocol order, the ones not exposed go to skip
+		for _, field := range []*int64{
+			&storageStat.TotalUploadCount, &storageStat.SuccessUploadCount,
+			&skip, &skip, //append
+			&skip, &skip, //modify
+			&skip, &skip, //truncate
+			&skip, &skip, //set metadata
+			&skip, &skip, //delete
+			&storageStat.TotalDownloadCount, &storageStat.SuccessDownloadCount,
+			&skip, &skip, //get metadata
+			&skip, &skip, //create link
+			&skip, &skip, //delete link
+			&storageStat.TotalUploadBytes, &storageStat.SuccessUploadBytes,
+			&skip, &skip, //append bytes
+			&skip, &skip, //modify bytes
+			&storageStat.TotalDownloadBytes, &storageStat.SuccessDownloadBytes,
+			&skip, &skip, //sync in bytes
+			&skip, &skip, //sync out bytes
+			&skip, &skip, //file open
+			&skip, &skip, //file read
+			&skip, &skip, //file write
+			&skip, &skip, &skip, //last source update, sync update, synced timestamp
+			&storageStat.LastHeartBeatTime,
+		} {
+			if err := binary.Read(buffer, binary.BigEndian, field); err != nil {
+				return err
+			}
+		}
+		ifTrunkServer, err := buffer.ReadByte()
+		if err != nil {
+			return err
+		}
+		storageStat.IfTrunkServer = ifTrunkServer != 0
+		this.storageStats = append(this.storageStats, storageStat)
+	}
+	return nil
+}
+
+type trackerDeleteStorageTask struct {
+	header
+	//req
+	groupName string
+	storageIP string
+}
+
+func (this *trackerDeleteStorageTask) SendReq(conn net.Conn) error {
+	this.cmd = TRACKER_PROTO_CMD_SERVER_DELETE_STORAGE
+	this.pkgLen = int64(FDFS_GROUP_NAME_MAX_LEN + len(this.storageIP))
+	if err := this.SendHeader(conn); err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	bufferGroupName := packGroupName(this.groupName)
+	buffer.Write(bufferGroupName[:])
+	buffer.WriteString(this.storageIP)
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (this *trackerDeleteStorageTask) RecvRes(conn net.Conn) error {
+	if err := this.RecvHeader(conn); err != nil {
+		return fmt.Errorf("TrackerDeleteStorageTask RecvHeader %w", err)
+	}
+	return nil
+}
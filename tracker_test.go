@@ -0,0 +1,189 @@
+package fdfs_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//replayConn answers reads from a canned response
+type replayConn struct {
+	recordConn
+	response *bytes.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.response.Read(b)
+}
+
+func TestQueryAllRecvRes(t *testing.T) {
+	body := new(bytes.Buffer)
+	group := packGroupName("group1")
+	body.Write(group[:])
+	var ip [IP_ADDRESS_SIZE - 1]byte
+	copy(ip[:], "10.0.0.1")
+	body.Write(ip[:])
+	binary.Write(body, binary.BigEndian, int64(23000))
+	for _, addr := range []string{"10.0.0.2", "10.0.0.3"} {
+		ip = [IP_ADDRESS_SIZE - 1]byte{}
+		copy(ip[:], addr)
+		body.Write(ip[:])
+	}
+	response := new(bytes.Buffer)
+	binary.Write(response, binary.BigEndian, int64(body.Len()))
+	response.Write([]byte{TRACKER_PROTO_CMD_RESP, 0})
+	response.Write(body.Bytes())
+
+	task := &trackerQueryAllTask{}
+	if err := task.RecvRes(&replayConn{response: bytes.NewReader(response.Bytes())}); err != nil {
+		t.Fatal(err)
+	}
+	if task.groupName != "group1" || task.port != 23000 {
+		t.Fatalf("group %q port %d", task.groupName, task.port)
+	}
+	if got := strings.Join(task.ipAddrs, ","); got != "10.0.0.1,10.0.0.2,10.0.0.3" {
+		t.Fatalf("ipAddrs = %s", got)
+	}
+}
+
+func TestListGroupsRecvRes(t *testing.T) {
+	body := new(bytes.Buffer)
+	for i, name := range []string{"group1", "group2"} {
+		var groupName [FDFS_GROUP_NAME_MAX_LEN + 1]byte
+		copy(groupName[:], name)
+		body.Write(groupName[:])
+		for field := int64(1); field <= 11; field++ {
+			binary.Write(body, binary.BigEndian, int64(i*100)+field)
+		}
+	}
+	response := new(bytes.Buffer)
+	binary.Write(response, binary.BigEndian, int64(body.Len()))
+	response.Write([]byte{TRACKER_PROTO_CMD_RESP, 0})
+	response.Write(body.Bytes())
+
+	task := &trackerListGroupsTask{}
+	if err := task.RecvRes(&replayConn{response: bytes.NewReader(response.Bytes())}); err != nil {
+		t.Fatal(err)
+	}
+	if len(task.groupStats) != 2 {
+		t.Fatalf("%d groups", len(task.groupStats))
+	}
+	group := task.groupStats[1]
+	if group.GroupName != "group2" || group.TotalMB != 101 || group.ActiveCount != 107 || group.CurrentTrunkFileId != 111 {
+		t.Fatalf("group = %+v", group)
+	}
+}
+
+func TestListStoragesRecvRes(t *testing.T) {
+	if TRACKER_STORAGE_STAT_SIZE != 612 {
+		t.Fatalf("TRACKER_STORAGE_STAT_SIZE = %d", TRACKER_STORAGE_STAT_SIZE)
+	}
+	record := make([]byte, TRACKER_STORAGE_STAT_SIZE)
+	record[0] = 7
+	copy(record[17:], "10.0.0.1")
+	binary.BigEndian.PutUint64(record[239:], 23000)
+	binary.BigEndian.PutUint64(record[275:], 5)
+	binary.BigEndian.PutUint64(record[603:], 1600000000)
+	record[611] = 1
+	response := new(bytes.Buffer)
+	binary.Write(response, binary.BigEndian, int64(len(record)))
+	response.Write([]byte{TRACKER_PROTO_CMD_RESP, 0})
+	response.Write(record)
+
+	task := &trackerListStoragesTask{}
+	if err := task.RecvRes(&replayConn{response: bytes.NewReader(response.Bytes())}); err != nil {
+		t.Fatal(err)
+	}
+	if len(task.storageStats) != 1 {
+		t.Fatalf("%d storages", len(task.storageStats))
+	}
+	storage := task.storageStats[0]
+	if storage.Status != StorageStatusActive || storage.IpAddr != "10.0.0.1" || storage.StoragePort != 23000 ||
+		storage.TotalUploadCount != 5 || storage.LastHeartBeatTime != 1600000000 || !storage.IfTrunkServer {
+		t.Fatalf("storage = %+v", storage)
+	}
+}
+
+func TestQueryStoreRecvResPort(t *testing.T) {
+	body := new(bytes.Buffer)
+	group := packGroupName("group1")
+	body.Write(group[:])
+	var ip [IP_ADDRESS_SIZE - 1]byte
+	copy(ip[:], "10.0.0.1")
+	body.Write(ip[:])
+	binary.Write(body, binary.BigEndian, int64(23001))
+	body.WriteByte(2)
+	response := new(bytes.Buffer)
+	binary.Write(response, binary.BigEndian, int64(body.Len()))
+	response.Write([]byte{TRACKER_PROTO_CMD_RESP, 0})
+	response.Write(body.Bytes())
+
+	task := &trackerTask{}
+	if err := task.RecvRes(&replayConn{response: bytes.NewReader(response.Bytes())}); err != nil {
+		t.Fatal(err)
+	}
+	if task.ipAddr != "10.0.0.1" || task.port != 23001 || task.storePathIndex != 2 {
+		t.Fatalf("ip %q port %d storePathIndex %d", task.ipAddr, task.port, task.storePathIndex)
+	}
+}
+
+func TestQueryRecvResNoStorage(t *testing.T) {
+	for _, body := range [][]byte{
+		nil,
+		make([]byte, 16),
+		//a full record with no ip in it
+		make([]byte, trackerStorageBodyLen),
+	} {
+		response := new(bytes.Buffer)
+		binary.Write(response, binary.BigEndian, int64(len(body)))
+		response.Write([]byte{TRACKER_PROTO_CMD_RESP, 0})
+		response.Write(body)
+
+		for _, task := range []task{&trackerTask{}, &trackerQueryAllTask{}} {
+			err := task.RecvRes(&replayConn{response: bytes.NewReader(response.Bytes())})
+			if !errors.Is(err, ErrNoAvailableStorage) {
+				t.Fatalf("%T with %d byte body: %v", task, len(body), err)
+			}
+		}
+	}
+}
+
+func TestQueryLongRemoteFilename(t *testing.T) {
+	client := &Client{config: &config{}}
+	remoteFilename := strings.Repeat("a", 1<<20)
+	//fails before any tracker is asked, there is none
+	if _, err := client.queryStorageInfoWithTracker(context.Background(), TRACKER_PROTO_CMD_SERVICE_QUERY_FETCH_ONE, "group1", remoteFilename); err == nil {
+		t.Fatal("queried with an oversized remote filename")
+	}
+	if _, err := client.queryAllStorageInfoWithTracker(context.Background(), "group1", remoteFilename); err == nil {
+		t.Fatal("queried all with an oversized remote filename")
+	}
+}
+
+func TestStorageStatusString(t *testing.T) {
+	//status bytes as fastdfs tracker_types.h defines them
+	for status, name := range map[int8]string{
+		0:  "INIT",
+		1:  "WAIT_SYNC",
+		2:  "SYNCING",
+		3:  "IP_CHANGED",
+		4:  "DELETED",
+		5:  "OFFLINE",
+		6:  "ONLINE",
+		7:  "ACTIVE",
+		9:  "RECOVERY",
+		99: "NONE",
+		8:  "UNKNOWN(8)",
+	} {
+		if got := StorageStatus(status).String(); got != name {
+			t.Errorf("status %d = %s, want %s", status, got, name)
+		}
+	}
+	if got := fmt.Sprint(StorageStat{Status: StorageStatusOffline}.Status); got != "OFFLINE" {
+		t.Fatalf("printed %s", got)
+	}
+}
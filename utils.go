@@ -2,6 +2,8 @@ package fdfs_client
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"net"
 )
 
@@ -38,40 +40,147 @@ func writeFromConnToBuffer(conn net.Conn, buffer []byte, size int64) error {
 			break
         }
 		recv, err = conn.Read(buffer[sizeRecv:sizeRecv + needRecv])
+		sizeRecv += int64(recv)
 		if err != nil {
-			return err
+			return shortReadOr(err, sizeAll, sizeRecv)
 		}
-		sizeRecv += int64(recv)
 	}
 	return nil
 }
 
-func writeFromConn(conn net.Conn, writer writer, size int64) error {
+func writeFromConn(conn net.Conn, writer writer, size int64) (int64, error) {
 	var (
 		err  error
 		recv int
+		written int
 		needRecv int64
 	)
 	sizeRecv, sizeAll := int64(0), size
-	buf := make([]byte, 4096)
+	buf := getBuffer(conn)
+	defer putBuffer(conn, buf)
 
 	for {
 		needRecv = sizeAll - sizeRecv
 		if needRecv <= 0 {
 			break
         }
-		if needRecv > 4096 {
-			needRecv = 4096
+		if needRecv > int64(len(buf)) {
+			needRecv = int64(len(buf))
         }
 		recv, err = conn.Read(buf[:needRecv])
-		if err != nil {
-			return err
+		if err != nil && recv == 0 {
+			return sizeRecv, shortReadOr(err, sizeAll, sizeRecv)
 		}
-		_, err = writer.Write(buf[:recv])
+		//the bytes that came with an error are still good
+		readErr := err
+		written, err = writer.Write(buf[:recv])
+		sizeRecv += int64(written)
 		if err != nil {
+			return sizeRecv, err
+		}
+		if written != recv {
+			return sizeRecv, io.ErrShortWrite
+		}
+		if readErr != nil {
+			return sizeRecv, shortReadOr(readErr, sizeAll, sizeRecv)
+		}
+	}
+	return sizeRecv, nil
+}
+
+//the conn closing before size bytes came is a ShortReadError
+func shortReadOr(err error, size int64, recv int64) error {
+	if err == io.EOF {
+		if recv >= size {
+			return nil
+		}
+		return &ShortReadError{Expected: size, Got: recv}
+	}
+	return err
+}
+
+//a response body of exactly len(buf) bytes
+func recvBody(conn net.Conn, buf []byte) error {
+	n, err := io.ReadFull(conn, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil {
+		return shortReadOr(err, int64(len(buf)), int64(n))
+	}
+	return nil
+}
+
+func sendFromReader(conn net.Conn, reader io.Reader, size int64) error {
+	buf := getBuffer(conn)
+	defer putBuffer(conn, buf)
+	sent, err := io.CopyBuffer(conn, io.LimitReader(reader, size), buf)
+	if err == nil && sent < size {
+		return fmt.Errorf("reader EOF after %d bytes, expect %d", sent, size)
+	}
+	return err
+}
+
+//the TCP conn under a pooled one, for sendfile
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	if pConn, ok := conn.(pConn); ok {
+		conn = pConn.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
+
+//reports after every chunk written, never after a failed one
+func sendWithProgress(conn net.Conn, reader io.Reader, size int64, progress func(sent, total int64)) error {
+	buf := getBuffer(conn)
+	defer putBuffer(conn, buf)
+	if len(buf) > 32*1024 {
+		buf = buf[:32*1024]
+	}
+	var sent int64
+	for sent < size {
+		n := int64(len(buf))
+		if size-sent < n {
+			n = size - sent
+		}
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			return fmt.Errorf("reader %v after %d bytes, expect %d", err, sent, size)
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
 			return err
 		}
-		sizeRecv += int64(recv)
+		sent += n
+		progress(sent, size)
+	}
+	if size == 0 {
+		progress(0, 0)
 	}
 	return nil
 }
+
+//reports the running count after every successful write
+type progressWriter struct {
+	writer   io.Writer
+	written  int64
+	total    int64
+	progress func(written, total int64)
+}
+
+func (this *progressWriter) Write(p []byte) (int, error) {
+	n, err := this.writer.Write(p)
+	this.written += int64(n)
+	if err == nil {
+		this.progress(this.written, this.total)
+	}
+	return n, err
+}
+
+//zeroReader reads zeros without end
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}